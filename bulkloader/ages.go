@@ -0,0 +1,118 @@
+package bulkloader
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AsOfLayout is the layout of an as-of date, e.g. 2017-06-01.
+const AsOfLayout = "2006-01-02"
+
+// ParseAsOf parses an as-of date in the AsOfLayout, returning the start of that day in UTC.
+func ParseAsOf(s string) (time.Time, error) {
+	asOf, err := time.Parse(AsOfLayout, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid as-of date '%s', expected YYYY-MM-DD", s)
+	}
+	return asOf, nil
+}
+
+// AgeBand is a range of ages the statistics are broken down by, as in the age dimension
+// table (e.g. synth_ma.synth_age_dim). The age_id of the band is the age_id in the fact
+// tables.
+type AgeBand struct {
+	AgeID  int
+	MinAge int
+	MaxAge int // -1 for no maximum
+}
+
+// Contains returns true if age is in the band.
+func (b AgeBand) Contains(age int) bool {
+	return age >= b.MinAge && (b.MaxAge < 0 || age <= b.MaxAge)
+}
+
+func (b AgeBand) String() string {
+	if b.MaxAge < 0 {
+		return fmt.Sprintf("%d=%d-", b.AgeID, b.MinAge)
+	}
+	return fmt.Sprintf("%d=%d-%d", b.AgeID, b.MinAge, b.MaxAge)
+}
+
+// AgeBands are the age bands patients are assigned to, sorted by age.
+type AgeBands []AgeBand
+
+// AllAges is a single band containing every age, for schemas without an age dimension
+// table.
+var AllAges = AgeBands{{AgeID: 1, MinAge: 0, MaxAge: -1}}
+
+// NewAgeBands sorts the bands by age, and returns an error if any of them are invalid or
+// overlap.
+func NewAgeBands(bands []AgeBand) (AgeBands, error) {
+	if len(bands) == 0 {
+		return nil, fmt.Errorf("no age bands")
+	}
+
+	sorted := append(AgeBands{}, bands...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].MinAge < sorted[j].MinAge })
+
+	ids := make(map[int]bool)
+	for i, b := range sorted {
+		if b.MinAge < 0 || (b.MaxAge >= 0 && b.MaxAge < b.MinAge) {
+			return nil, fmt.Errorf("invalid age band %s", b)
+		}
+		if ids[b.AgeID] {
+			return nil, fmt.Errorf("duplicate age band ID %d", b.AgeID)
+		}
+		ids[b.AgeID] = true
+		if i > 0 && sorted[i-1].Contains(b.MinAge) {
+			return nil, fmt.Errorf("age bands %s and %s overlap", sorted[i-1], b)
+		}
+	}
+	return sorted, nil
+}
+
+// ParseAgeBands parses a comma-separated list of age bands, each "age_id=min-max", or
+// "age_id=min-" for a band with no maximum, e.g. "1=0-17,2=18-64,3=65-".
+func ParseAgeBands(s string) (AgeBands, error) {
+	var bands []AgeBand
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid age band '%s', expected age_id=min-max", pair)
+		}
+		ages := strings.SplitN(parts[1], "-", 2)
+		if len(ages) != 2 {
+			return nil, fmt.Errorf("invalid age band '%s', expected age_id=min-max", pair)
+		}
+
+		b := AgeBand{MaxAge: -1}
+		var err error
+		if b.AgeID, err = strconv.Atoi(parts[0]); err != nil {
+			return nil, fmt.Errorf("invalid age band ID in '%s'", pair)
+		}
+		if b.MinAge, err = strconv.Atoi(ages[0]); err != nil {
+			return nil, fmt.Errorf("invalid minimum age in '%s'", pair)
+		}
+		if ages[1] != "" {
+			if b.MaxAge, err = strconv.Atoi(ages[1]); err != nil {
+				return nil, fmt.Errorf("invalid maximum age in '%s'", pair)
+			}
+		}
+		bands = append(bands, b)
+	}
+	return NewAgeBands(bands)
+}
+
+// AgeID returns the age_id of the band containing age, or false if no band does.
+func (bands AgeBands) AgeID(age int) (int, bool) {
+	for _, b := range bands {
+		if b.Contains(age) {
+			return b.AgeID, true
+		}
+	}
+	return 0, false
+}
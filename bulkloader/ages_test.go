@@ -0,0 +1,226 @@
+package bulkloader
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+func TestNewAgeBands(t *testing.T) {
+	tests := []struct {
+		name    string
+		bands   []AgeBand
+		want    AgeBands
+		wantErr bool
+	}{
+		{
+			name:  "sorted by minimum age",
+			bands: []AgeBand{{2, 18, -1}, {1, 0, 17}},
+			want:  AgeBands{{1, 0, 17}, {2, 18, -1}},
+		},
+		{
+			name:  "gap between bands",
+			bands: []AgeBand{{1, 0, 17}, {2, 65, -1}},
+			want:  AgeBands{{1, 0, 17}, {2, 65, -1}},
+		},
+		{
+			name:    "overlap",
+			bands:   []AgeBand{{1, 0, 18}, {2, 18, 64}},
+			wantErr: true,
+		},
+		{
+			name:    "overlap with an open upper bound",
+			bands:   []AgeBand{{1, 0, -1}, {2, 65, -1}},
+			wantErr: true,
+		},
+		{
+			name:    "maximum below minimum",
+			bands:   []AgeBand{{1, 18, 17}},
+			wantErr: true,
+		},
+		{
+			name:    "negative minimum",
+			bands:   []AgeBand{{1, -1, 17}},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate ID",
+			bands:   []AgeBand{{1, 0, 17}, {1, 18, -1}},
+			wantErr: true,
+		},
+		{
+			name:    "no bands",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := NewAgeBands(tt.bands)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseAgeBands(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    AgeBands
+		wantErr bool
+	}{
+		{s: "1=0-17,2=18-64,3=65-", want: AgeBands{{1, 0, 17}, {2, 18, 64}, {3, 65, -1}}},
+		{s: " 2=18-64 , 1=0-17 ", want: AgeBands{{1, 0, 17}, {2, 18, 64}}},
+		{s: "1=0-17,2=65-", want: AgeBands{{1, 0, 17}, {2, 65, -1}}},
+		{s: "1=0-", want: AgeBands{{1, 0, -1}}},
+		{s: "1=0-17,2=17-64", wantErr: true},
+		{s: "1=0-,2=65-", wantErr: true},
+		{s: "1=0", wantErr: true},
+		{s: "0-17", wantErr: true},
+		{s: "a=0-17", wantErr: true},
+		{s: "1=a-17", wantErr: true},
+		{s: "1=0-a", wantErr: true},
+		{s: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseAgeBands(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseAgeBands(%q): got error %v, want error %t", tt.s, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseAgeBands(%q): got %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestAgeID(t *testing.T) {
+	bands := AgeBands{{1, 0, 17}, {2, 18, 64}, {3, 80, -1}}
+	tests := []struct {
+		age    int
+		wantID int
+		wantOK bool
+	}{
+		{0, 1, true},
+		{17, 1, true},
+		{18, 2, true},
+		{64, 2, true},
+		{65, 0, false}, // in the gap
+		{80, 3, true},
+		{120, 3, true},
+	}
+
+	for _, tt := range tests {
+		id, ok := bands.AgeID(tt.age)
+		if id != tt.wantID || ok != tt.wantOK {
+			t.Errorf("AgeID(%d): got %d, %t, want %d, %t", tt.age, id, ok, tt.wantID, tt.wantOK)
+		}
+	}
+}
+
+func date(s string) time.Time {
+	t, err := time.Parse(AsOfLayout, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func datePtr(s string) *time.Time {
+	t := date(s)
+	return &t
+}
+
+func TestGetAge(t *testing.T) {
+	tests := []struct {
+		bd, asOf string
+		want     int
+	}{
+		{"1980-06-15", "2017-06-14", 36},
+		{"1980-06-15", "2017-06-15", 37},
+		{"1980-06-15", "1980-06-15", 0},
+		// a Feb 29 birthday is on Mar 1 in years that aren't leap years
+		{"2000-02-29", "2001-02-28", 0},
+		{"2000-02-29", "2001-03-01", 1},
+		{"2000-02-29", "2004-02-28", 3},
+		{"2000-02-29", "2004-02-29", 4},
+	}
+
+	for _, tt := range tests {
+		if got := getAge(date(tt.bd), date(tt.asOf)); got != tt.want {
+			t.Errorf("getAge(%s, %s) = %d, want %d", tt.bd, tt.asOf, got, tt.want)
+		}
+	}
+}
+
+func TestSetPatientStatsDeath(t *testing.T) {
+	asOf := date("2017-06-01")
+	deceased := true
+	tests := []struct {
+		name            string
+		deceasedBoolean *bool
+		deceasedAt      string
+		wantAge         int
+		wantDeceased    bool
+		wantDeathYear   int
+	}{
+		{name: "living", wantAge: 47},
+		{name: "died before as-of", deceasedAt: "2010-03-01", wantAge: 40, wantDeceased: true, wantDeathYear: 2010},
+		{name: "died after as-of", deceasedAt: "2017-06-02", wantAge: 47},
+		{name: "died on as-of", deceasedAt: "2017-06-01", wantAge: 47, wantDeceased: true, wantDeathYear: 2017},
+		{name: "deceased with no date", deceasedBoolean: &deceased, wantAge: 47, wantDeceased: true},
+	}
+
+	for _, tt := range tests {
+		p := &models.Patient{
+			BirthDate:       &models.FHIRDateTime{Time: date("1970-01-15")},
+			DeceasedBoolean: tt.deceasedBoolean,
+			Address:         []models.Address{{City: "Bedford"}},
+		}
+		p.Id = "p1"
+		if tt.deceasedAt != "" {
+			p.DeceasedDateTime = &models.FHIRDateTime{Time: date(tt.deceasedAt)}
+		}
+
+		var basestat RawStats
+		warning, err := setPatientStats(&basestat, p, CousubMap{}, AllAges, asOf)
+		if warning != nil || err != nil {
+			t.Errorf("%s: got warning %v, error %v", tt.name, warning, err)
+			continue
+		}
+		if basestat.Age != tt.wantAge || basestat.DeceasedBoolean != tt.wantDeceased || basestat.DeathYear != tt.wantDeathYear {
+			t.Errorf("%s: got age %d, deceased %t, death year %d, want %d, %t, %d", tt.name,
+				basestat.Age, basestat.DeceasedBoolean, basestat.DeathYear, tt.wantAge, tt.wantDeceased, tt.wantDeathYear)
+		}
+	}
+}
+
+func TestSetPatientStatsWarnings(t *testing.T) {
+	asOf := date("2017-06-01")
+	tests := []struct {
+		name string
+		bd   string
+		ages AgeBands
+	}{
+		{"born after as-of", "2017-06-02", AllAges},
+		{"not in any age band", "1970-01-15", AgeBands{{1, 0, 17}}},
+	}
+
+	for _, tt := range tests {
+		p := &models.Patient{
+			BirthDate: &models.FHIRDateTime{Time: date(tt.bd)},
+			Address:   []models.Address{{City: "Bedford"}},
+		}
+		var basestat RawStats
+		warning, err := setPatientStats(&basestat, p, CousubMap{}, tt.ages, asOf)
+		if warning == nil || err != nil {
+			t.Errorf("%s: got warning %v, error %v, want a warning", tt.name, warning, err)
+		}
+	}
+}
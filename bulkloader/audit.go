@@ -0,0 +1,198 @@
+package bulkloader
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Run statuses recorded in the load_runs table.
+const (
+	// RunRunning is a load that's in progress, or that was interrupted if it has no
+	// finished_at time.
+	RunRunning = "running"
+	// RunSucceeded is a load in which every bundle loaded.
+	RunSucceeded = "succeeded"
+	// RunPartial is a load that finished, but in which some bundles failed to load.
+	RunPartial = "partial"
+	// RunFailed is a load that stopped with a fatal error.
+	RunFailed = "failed"
+	// RunRolledBack is a load that was undone by the rollback command.
+	RunRolledBack = "rolled_back"
+)
+
+// kvPassword matches the password in a key/value connection string, e.g. "password=secret".
+var kvPassword = regexp.MustCompile(`(?i)(password\s*=\s*)('[^']*'|\S+)`)
+
+// RedactSecrets returns value with any password in it, either in a URL (e.g. a Postgres or
+// Mongo connection string, including a Mongo one without a scheme, like
+// "user:secret@host:27017") or a key/value connection string, replaced with "xxxxx".
+func RedactSecrets(value string) string {
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+			value = u.String()
+		}
+	} else if !strings.Contains(value, "://") {
+		// mgo's "[user:pass@]host1[:port1][,host2[:port2],...][/database][?options]". The
+		// hosts can't contain an "@", so the last one before the database ends the password.
+		hosts := value
+		if slash := strings.Index(hosts, "/"); slash >= 0 {
+			hosts = hosts[:slash]
+		}
+		if at := strings.LastIndex(hosts, "@"); at >= 0 {
+			userinfo := hosts[:at]
+			if colon := strings.Index(userinfo, ":"); colon >= 0 && !strings.Contains(userinfo, " ") {
+				value = userinfo[:colon+1] + "xxxxx" + value[at:]
+			}
+		}
+	}
+	if q := kvPassword.FindStringSubmatchIndex(value); q != nil {
+		value = value[:q[3]] + "xxxxx" + value[q[5]:]
+	}
+	return value
+}
+
+// AuditPaths are the paths a load run reads from and writes to, so that the bundles it
+// loaded and the report of those that failed can be found from its row in the audit table.
+type AuditPaths struct {
+	Source  string // the directory or archive of bundles (or NDJSON files) loaded
+	Journal string // the checkpoint journal
+	Report  string // the JSON report of failed bundles
+}
+
+// AuditRun records a load run in the load_runs audit table, so that it's known when each
+// load happened, what it loaded and how it went.
+type AuditRun struct {
+	db     *sql.DB
+	retry  RetryPolicy
+	schema Schema
+	runID  string
+
+	// the counts recorded by the earlier attempts at a resumed run
+	succeeded int
+	resources int
+	warnings  int
+	written   map[string]int
+}
+
+// StartAuditRun records the start of a load run with the given command line options and paths. The options should already have
+// had their secrets redacted with RedactSecrets. If the run is being resumed it's marked as
+// running again, and the counts already recorded for it are added to those of this attempt
+// when it finishes.
+func StartAuditRun(db *sql.DB, retry RetryPolicy, schema Schema, runID string, started time.Time, options map[string]string, paths AuditPaths) (*AuditRun, error) {
+	optionsJSON, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+
+	run := &AuditRun{db: db, retry: retry, schema: schema, runID: runID}
+	err = retry.Do("Recording load run", func(attempt int) error {
+		err := db.QueryRow(`insert into `+schema.Table(schema.LoadRuns)+` (run_id, started_at, status, options, source, journal_path, report_path)
+			values ($1, $2, $3, $4, $5, $6, $7)
+			on conflict (run_id) do update set finished_at = null, status = excluded.status, options = excluded.options,
+				source = excluded.source, journal_path = excluded.journal_path, report_path = excluded.report_path, error = null
+			returning bundles_succeeded, resources, warnings`,
+			runID, started, RunRunning, string(optionsJSON), paths.Source, paths.Journal, paths.Report).Scan(&run.succeeded, &run.resources, &run.warnings)
+		if err != nil {
+			return err
+		}
+
+		rows, err := db.Query(`select resource_type, resources from `+schema.Table(schema.LoadRunCounts)+` where run_id = $1`, runID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		run.written = make(map[string]int)
+		for rows.Next() {
+			var resourceType string
+			var n int
+			if err = rows.Scan(&resourceType, &n); err != nil {
+				return err
+			}
+			run.written[resourceType] = n
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// Finish records the end of the load run, with the counts from its report and the number
+// of resources of each type that were written. The failed bundles of an earlier attempt at
+// a resumed run are retried, so only the failures of this attempt are counted.
+func (a *AuditRun) Finish(report *ErrorReport, written map[string]int) error {
+	status := RunSucceeded
+	if _, failed, _ := report.Counts(); failed > 0 {
+		status = RunPartial
+	}
+	return a.finish(status, report, written, nil)
+}
+
+// Fail records that the load run stopped with a fatal error, with the counts so far.
+func (a *AuditRun) Fail(report *ErrorReport, written map[string]int, failure string) error {
+	return a.finish(RunFailed, report, written, &failure)
+}
+
+// finish records the end of the load run with the given status, and the error that stopped
+// it, if any.
+func (a *AuditRun) finish(status string, report *ErrorReport, written map[string]int, failure *string) error {
+	succeeded, failed, warnings := report.Counts()
+
+	resources := a.resources
+	total := make(map[string]int)
+	for resourceType, n := range a.written {
+		total[resourceType] = n
+	}
+	for resourceType, n := range written {
+		resources += n
+		total[resourceType] += n
+	}
+
+	return a.retry.Do("Recording load run", func(attempt int) error {
+		txn, err := a.db.Begin()
+		if err != nil {
+			return err
+		}
+		// a no-op once the transaction is committed
+		defer txn.Rollback()
+
+		_, err = txn.Exec(`update `+a.schema.Table(a.schema.LoadRuns)+`
+			set finished_at = $2, status = $3, bundles_succeeded = $4, bundles_failed = $5, resources = $6, warnings = $7, error = $8
+			where run_id = $1`,
+			a.runID, time.Now(), status, a.succeeded+succeeded, failed, resources, a.warnings+warnings, failure)
+		if err != nil {
+			return err
+		}
+
+		for _, resourceType := range sortedKeys(total) {
+			_, err = txn.Exec(`insert into `+a.schema.Table(a.schema.LoadRunCounts)+` (run_id, resource_type, resources) values ($1, $2, $3)
+				on conflict (run_id, resource_type) do update set resources = excluded.resources`,
+				a.runID, resourceType, total[resourceType])
+			if err != nil {
+				return err
+			}
+		}
+		return txn.Commit()
+	})
+}
+
+// MarkRolledBack records that a load run was rolled back. Runs from before the audit
+// tables existed are ignored, as are all runs if the schema has no audit tables (e.g. it
+// isn't managed by Migrate).
+func MarkRolledBack(db *sql.DB, retry RetryPolicy, schema Schema, runID string) error {
+	return retry.Do("Recording load run", func(attempt int) error {
+		var exists bool
+		err := db.QueryRow(`select to_regclass($1) is not null`, schema.Table(schema.LoadRuns)).Scan(&exists)
+		if err != nil || !exists {
+			return err
+		}
+		_, err = db.Exec(`update `+schema.Table(schema.LoadRuns)+` set status = $2 where run_id = $1`, runID, RunRolledBack)
+		return err
+	})
+}
@@ -1,14 +1,16 @@
 package bulkloader
 
 import (
-	"errors"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/intervention-engine/fhir/models"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 // CousubMap maps a county subdivision ID (called "csfips" in the synth_ma.synth_cousub_dim
@@ -50,116 +52,452 @@ func removeDuplicates(conditions []ConditionCode) ([]int, []int) {
 	return uniqueC, uniqueD
 }
 
-// getAge returns the person's current age given his/her Birthdate bd
-func getAge(bd time.Time) int {
-	i := 1
-	for time.Now().AddDate(i*-1, 0, 0).After(bd) {
-		i++
+// filterConditions returns the conditions for which keep returns true.
+func filterConditions(conditions []ConditionCode, keep func(ConditionCode) bool) []ConditionCode {
+	var kept []ConditionCode
+	for _, c := range conditions {
+		if keep(c) {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// getAge returns the person's age in whole years at the time asOf, given his/her Birthdate bd
+func getAge(bd, asOf time.Time) int {
+	age := asOf.Year() - bd.Year()
+	if asOf.Before(bd.AddDate(age, 0, 0)) {
+		// not had a birthday yet that year
+		age--
 	}
-	return i - 1
+	return age
+}
+
+// Uploader uploads resources to the Mongo database, collecting the statistics for them in
+// the rawstat collection as it goes. An Uploader is safe for use by multiple workers at once.
+type Uploader struct {
+	Session  *mgo.Session
+	DBName   string
+	Cousubs  CousubMap
+	Diseases DiseaseMap
+	AgeBands AgeBands
+	// AsOf is the time the patients' ages are calculated at, so that loading the same data
+	// with the same AsOf time gives the same statistics.
+	AsOf  time.Time
+	Retry RetryPolicy
+	// Upsert writes resources and rawstat documents with upserts rather than inserts, so
+	// that uploading a resource with the same ID again replaces it. Use it with
+	// DeterministicIDs.
+	Upsert bool
+	// CheckCollisions fails the upload of resources whose IDs are already in Mongo. Use it
+	// with PreservedIDs, where the IDs come from the source data.
+	CheckCollisions bool
+	// Manifest, if not nil, records the collections the Uploader writes to.
+	Manifest *Manifest
+
+	mu      sync.Mutex
+	written map[string]int // resources written by resource type
 }
 
 // UploadResources uploads all resources in FHIR bundle to the Mongo database, collecting the
 // relevant statistics before uploading. NOTE: This is a destructive operation.  Resources will
 // be updated with new server-assigned ID and all references to this ID will point to other
-// resources on the server.
-func UploadResources(resources []interface{}, mgoSession *mgo.Session, dbName string, cousubs CousubMap, diseases DiseaseMap) {
+// resources on the server. If the statistics can't be collected nothing is uploaded. The
+// returned error is a *BundleError, without the path of the bundle. Data quality problems
+// that don't stop the upload, e.g. conditions with no code, are returned as warnings. A
+// patient who can't be counted in the statistics is one of those: the resources are
+// uploaded, but no rawstat document is written for the patient.
+func (u *Uploader) UploadResources(resources []interface{}) (warnings []error, err error) {
 
 	var basestat RawStats
-	var condcode ConditionCode
+	skipStats := false
+
+	for _, t := range resources {
+		switch r := t.(type) {
+		case *models.Patient:
+			warning, err := setPatientStats(&basestat, r, u.Cousubs, u.AgeBands, u.AsOf)
+			if err != nil {
+				return nil, stageError(StageStats, err)
+			}
+			if warning != nil {
+				warnings = append(warnings, warning)
+				skipStats = true
+			}
+		case *models.Condition:
+			condcodes, err := getConditionCodes(r, u.Diseases)
+			if err != nil {
+				warnings = append(warnings, err)
+				break
+			}
+			basestat.Conditions = append(basestat.Conditions, condcodes...)
+		case *models.Observation:
+			if cause, ok := getCauseOfDeath(r, u.Diseases); ok {
+				basestat.CauseOfDeath = &cause
+			}
+		}
+	}
 
 	// create a copy of the master Mongo session for this upload
-	session := mgoSession.Copy()
+	session := u.Session.Copy()
 	defer session.Close()
 
+	if err := u.checkCollisions(session, resources); err != nil {
+		return nil, err
+	}
+
+	SetMeta(resources, time.Now())
+	TagRun(resources, u.runID())
+	if err := u.insertResources(session, resources); err != nil {
+		return nil, stageError(StageMongo, err)
+	}
+
+	if skipStats {
+		return warnings, nil
+	}
+	if err := u.recordCollection("rawstat"); err != nil {
+		return nil, stageError(StageMongo, err)
+	}
+	c := session.DB(u.DBName).C("rawstat")
+	basestat.UniqueConditions, basestat.UniqueDiseases = removeDuplicates(filterConditions(basestat.Conditions, ConditionCode.Diagnosed))
+	basestat.ActiveConditions, basestat.ActiveDiseases = removeDuplicates(filterConditions(basestat.Conditions, func(c ConditionCode) bool {
+		return c.ActiveAt(u.AsOf)
+	}))
+	basestat.RunID = u.runID()
+	err = u.Retry.DoMongo(session, "Inserting rawstat", func(attempt int) error {
+		var err error
+		if u.Upsert {
+			_, err = c.UpsertId(basestat.ID, basestat)
+		} else {
+			err = c.Insert(basestat)
+		}
+		if attempt > 1 && mgo.IsDup(err) {
+			// inserted by an earlier attempt
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, stageError(StageMongo, err)
+	}
+	return warnings, nil
+}
+
+// insertResources bulk inserts the resources into the collection for each resource type.
+// Failed inserts are retried according to the Uploader's RetryPolicy. Since the resources
+// already have their IDs, any that an earlier attempt managed to insert fail with a
+// duplicate key error when retried, rather than being inserted twice.
+func (u *Uploader) insertResources(session *mgo.Session, resources []interface{}) error {
+
 	forMango := make(map[string][]interface{})
 
 	for _, t := range resources {
-
 		resourceType := reflect.TypeOf(t).Elem().Name()
 		collection := models.PluralizeLowerResourceName(resourceType)
 
 		forMango[collection] = append(forMango[collection], t)
+	}
 
-		if resourceType == "Patient" {
-			p, ok := t.(*models.Patient)
-			if ok {
-				basestat.ID = p.Id
-				basestat.Gender = p.Gender
-				basestat.Age = getAge(p.BirthDate.Time)
-				basestat.AgeRange = 1
-				basestat.DeceasedBoolean = p.DeceasedDateTime != nil || (p.DeceasedBoolean != nil && *p.DeceasedBoolean)
-				basestat.Location.City = p.Address[0].City
-				basestat.Location.ZipCode = p.Address[0].PostalCode
-				basestat.Location.CountyIDFips = cousubs[p.Address[0].City].CountyIDFips
-				basestat.Location.SubCountyIDFips = cousubs[p.Address[0].City].SubCountyIDFips
-			}
+	for key, value := range forMango {
+		if err := u.recordCollection(key); err != nil {
+			return fmt.Errorf("failed to record %s in the manifest: %s", key, err)
 		}
-
-		if resourceType == "Condition" {
-			p, ok := t.(*models.Condition)
-			if ok {
-				condcode.Code = p.Code.Coding[0].Code
-				condcode.System = p.Code.Coding[0].System
-				condcode.DiseaseID = diseases[DiseaseKey{condcode.System, condcode.Code}].DiseaseID
-				condcode.ConditionID = diseases[DiseaseKey{condcode.System, condcode.Code}].ConditionID
-				basestat.Conditions = append(basestat.Conditions, condcode)
+		c := session.DB(u.DBName).C(key)
+		err := u.Retry.DoMongo(session, "Inserting "+key, func(attempt int) error {
+			x := c.Bulk()
+			x.Unordered()
+			if u.Upsert {
+				x.Upsert(upsertPairs(value)...)
+			} else {
+				x.Insert(value...)
+			}
+			_, err := x.Run()
+			if attempt > 1 && mgo.IsDup(err) {
+				// the only failures were resources inserted by an earlier attempt
+				return nil
 			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to insert %s: %s", key, err)
 		}
+		u.countWritten(value)
 	}
+	return nil
+}
 
-	for key, value := range forMango {
-		c := session.DB(dbName).C(key)
-		x := c.Bulk()
-		x.Unordered()
-		x.Insert(value...)
-		_, err := x.Run()
+// countWritten counts resources that have been written, by resource type.
+func (u *Uploader) countWritten(resources []interface{}) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.written == nil {
+		u.written = make(map[string]int)
+	}
+	for _, t := range resources {
+		u.written[reflect.TypeOf(t).Elem().Name()]++
+	}
+}
+
+// Written returns the number of resources of each type that have been written.
+func (u *Uploader) Written() map[string]int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	written := make(map[string]int)
+	for resourceType, n := range u.written {
+		written[resourceType] = n
+	}
+	return written
+}
+
+// checkCollisions returns a StageID *BundleError listing any of the resources whose IDs
+// are already in Mongo, if the Uploader checks for collisions.
+func (u *Uploader) checkCollisions(session *mgo.Session, resources []interface{}) error {
+	if !u.CheckCollisions {
+		return nil
+	}
+
+	idsByType := make(map[string][]string)
+	for _, t := range resources {
+		resourceType := reflect.TypeOf(t).Elem().Name()
+		idsByType[resourceType] = append(idsByType[resourceType], GetID(t))
+	}
+
+	var collisions []string
+	for resourceType, ids := range idsByType {
+		c := session.DB(u.DBName).C(models.PluralizeLowerResourceName(resourceType))
+		var existing []struct {
+			ID string `bson:"_id"`
+		}
+		err := u.Retry.DoMongo(session, "Checking "+c.Name+" for existing IDs", func(attempt int) error {
+			return c.Find(bson.M{"_id": bson.M{"$in": ids}}).Select(bson.M{"_id": 1}).All(&existing)
+		})
 		if err != nil {
-			panic(err)
+			return stageError(StageMongo, err)
+		}
+		for _, e := range existing {
+			collisions = append(collisions, resourceType+"/"+e.ID)
 		}
 	}
 
-	c := session.DB(dbName).C("rawstat")
-	basestat.UniqueConditions, basestat.UniqueDiseases = removeDuplicates(basestat.Conditions)
-	c.Insert(basestat)
+	if len(collisions) > 0 {
+		sort.Strings(collisions)
+		return stageError(StageID, fmt.Errorf("IDs already in Mongo: %s", strings.Join(collisions, ", ")))
+	}
+	return nil
 }
 
-func updateReferences(resource interface{}, refMap map[string]string) error {
-	refs := getAllReferences(resource)
-	for _, ref := range refs {
-		if err := updateReference(ref, refMap); err != nil {
-			return err
+// upsertPairs returns the selector/document pairs to upsert each of the resources by ID.
+func upsertPairs(resources []interface{}) []interface{} {
+	pairs := make([]interface{}, 0, 2*len(resources))
+	for _, r := range resources {
+		pairs = append(pairs, bson.M{"_id": GetID(r)}, r)
+	}
+	return pairs
+}
+
+// setPatientStats copies the demographics tracked in the rawstat collection from the
+// patient p to basestat, as of the time asOf, assigning the patient to one of the age
+// bands. A patient who died before asOf is counted at their age at death, and a patient
+// who died after it as living. It returns an error if the patient's data is incomplete, and
+// a warning if the patient can't be counted in the statistics (e.g. their age isn't in any
+// band), in which case the patient is left out of them but still loaded.
+func setPatientStats(basestat *RawStats, p *models.Patient, cousubs CousubMap, ages AgeBands, asOf time.Time) (warning, err error) {
+	if p.BirthDate == nil {
+		return nil, fmt.Errorf("patient %s has no birth date", p.Id)
+	}
+	if len(p.Address) == 0 {
+		return nil, fmt.Errorf("patient %s has no address", p.Id)
+	}
+
+	basestat.ID = p.Id
+	basestat.Gender = p.Gender
+	if p.BirthDate.Time.After(asOf) {
+		return fmt.Errorf("patient %s was born after %s, so is left out of the statistics", p.Id, asOf.Format(AsOfLayout)), nil
+	}
+
+	at := asOf
+	deceased := p.DeceasedBoolean != nil && *p.DeceasedBoolean
+	if p.DeceasedDateTime != nil {
+		deceased = !p.DeceasedDateTime.Time.After(asOf)
+		if deceased {
+			at = p.DeceasedDateTime.Time
 		}
 	}
-	return nil
+
+	basestat.Age = getAge(p.BirthDate.Time, at)
+	ageID, ok := ages.AgeID(basestat.Age)
+	if !ok {
+		return fmt.Errorf("patient %s is %d, which isn't in any age band, so is left out of the statistics", p.Id, basestat.Age), nil
+	}
+	basestat.AgeRange = ageID
+	basestat.DeceasedBoolean = deceased
+	if deceased && p.DeceasedDateTime != nil {
+		basestat.DeathYear = p.DeceasedDateTime.Time.Year()
+	}
+	basestat.Location.City = p.Address[0].City
+	basestat.Location.ZipCode = p.Address[0].PostalCode
+	basestat.Location.CountyIDFips = cousubs[p.Address[0].City].CountyIDFips
+	basestat.Location.SubCountyIDFips = cousubs[p.Address[0].City].SubCountyIDFips
+	return nil, nil
 }
 
-func updateReference(ref *models.Reference, refMap map[string]string) error {
-	if ref != nil && strings.HasPrefix(ref.Reference, "cid:") {
-		newRef, ok := refMap[strings.TrimPrefix(ref.Reference, "cid:")]
-		if ok {
-			ref.Reference = newRef
-		} else {
-			return errors.New(fmt.Sprint("Failed to find updated reference for ", ref))
+// getConditionCodes maps the condition c to the conditions and diseases we track statistics
+// for, by every one of its codings, along with its status, onset and abatement. It returns
+// an error if c has no coding with a code.
+func getConditionCodes(c *models.Condition, diseases DiseaseMap) ([]ConditionCode, error) {
+	var codings []models.Coding
+	if c.Code != nil {
+		codings = c.Code.Coding
+	}
+	condcodes := mapCodings(codings, diseases)
+	if len(condcodes) == 0 {
+		return nil, fmt.Errorf("condition %s has no code", c.Id)
+	}
+
+	var onset, abatement *time.Time
+	switch {
+	case c.OnsetDateTime != nil:
+		onset = &c.OnsetDateTime.Time
+	case c.OnsetPeriod != nil && c.OnsetPeriod.Start != nil:
+		onset = &c.OnsetPeriod.Start.Time
+	}
+	switch {
+	case c.AbatementDateTime != nil:
+		abatement = &c.AbatementDateTime.Time
+	case c.AbatementPeriod != nil && c.AbatementPeriod.End != nil:
+		abatement = &c.AbatementPeriod.End.Time
+	}
+
+	for i := range condcodes {
+		condcodes[i].ClinicalStatus = c.ClinicalStatus
+		condcodes[i].VerificationStatus = c.VerificationStatus
+		condcodes[i].Onset = onset
+		condcodes[i].Abatement = abatement
+		condcodes[i].Abated = c.AbatementBoolean != nil && *c.AbatementBoolean
+	}
+	return condcodes, nil
+}
+
+// Diagnosed returns true if the patient was ever diagnosed with the condition, i.e. it
+// wasn't refuted or entered in error.
+func (c ConditionCode) Diagnosed() bool {
+	return c.VerificationStatus != "entered-in-error" && c.VerificationStatus != "refuted"
+}
+
+// ActiveAt returns true if the patient had the condition at the time asOf: it was
+// diagnosed, its onset was by then (or isn't known), and it hadn't abated. A condition
+// that has abated, or is resolved, inactive or in remission, but has no abatement date is
+// assumed to have abated before asOf.
+func (c ConditionCode) ActiveAt(asOf time.Time) bool {
+	if !c.Diagnosed() {
+		return false
+	}
+	if c.Onset != nil && c.Onset.After(asOf) {
+		return false
+	}
+	if c.Abatement != nil {
+		return c.Abatement.After(asOf)
+	}
+	switch c.ClinicalStatus {
+	case "resolved", "inactive", "remission":
+		return false
+	}
+	return !c.Abated
+}
+
+// conditionUpdate returns the update that adds the conditions to a patient's rawstat
+// document, as of the time asOf. It uses $addToSet rather than $push, so that retrying the
+// update can't count a condition twice.
+func conditionUpdate(condcodes []ConditionCode, asOf time.Time) bson.M {
+	var conditionIDs, diseaseIDs, activeConditionIDs, activeDiseaseIDs []int
+	for _, condcode := range condcodes {
+		if condcode.Diagnosed() {
+			conditionIDs = append(conditionIDs, condcode.ConditionID)
+			diseaseIDs = append(diseaseIDs, condcode.DiseaseID)
+		}
+		if condcode.ActiveAt(asOf) {
+			activeConditionIDs = append(activeConditionIDs, condcode.ConditionID)
+			activeDiseaseIDs = append(activeDiseaseIDs, condcode.DiseaseID)
 		}
 	}
-	return nil
+	return bson.M{
+		"$addToSet": bson.M{
+			"conditions":       bson.M{"$each": condcodes},
+			"uniqueconditions": bson.M{"$each": nonNil(conditionIDs)},
+			"uniquediseases":   bson.M{"$each": nonNil(diseaseIDs)},
+			"activeconditions": bson.M{"$each": nonNil(activeConditionIDs)},
+			"activediseases":   bson.M{"$each": nonNil(activeDiseaseIDs)},
+		},
+	}
 }
 
-func getAllReferences(model interface{}) []*models.Reference {
-	var refs []*models.Reference
-	s := reflect.ValueOf(model).Elem()
-	for i := 0; i < s.NumField(); i++ {
-		f := s.Field(i)
-		if f.Type() == reflect.TypeOf(&models.Reference{}) && !f.IsNil() {
-			refs = append(refs, f.Interface().(*models.Reference))
-		} else if f.Type() == reflect.TypeOf([]models.Reference{}) {
-			for j := 0; j < f.Len(); j++ {
-				refs = append(refs, f.Index(j).Addr().Interface().(*models.Reference))
-			}
+// nonNil returns ids, or an empty slice if it's nil, since $each needs an array.
+func nonNil(ids []int) []int {
+	if ids == nil {
+		return []int{}
+	}
+	return ids
+}
+
+// mapCodings maps each of the codings that's a condition we track statistics for to that
+// condition and its disease. If none of them are tracked, the first coding with a code is
+// returned, with no condition or disease, so that the code is still recorded. Codings with
+// no code are ignored, so if none have one nothing is returned.
+func mapCodings(codings []models.Coding, diseases DiseaseMap) []ConditionCode {
+	var condcodes []ConditionCode
+	var untracked []ConditionCode
+	for _, coding := range codings {
+		if coding.Code == "" {
+			continue
+		}
+		condcode := ConditionCode{System: coding.System, Code: coding.Code}
+		if disease, ok := diseases[DiseaseKey{coding.System, coding.Code}]; ok {
+			condcode.ConditionID = disease.ConditionID
+			condcode.DiseaseID = disease.DiseaseID
+			condcodes = append(condcodes, condcode)
+		} else if len(untracked) == 0 {
+			untracked = append(untracked, condcode)
 		}
 	}
-	return refs
+	if len(condcodes) == 0 {
+		return untracked
+	}
+	return condcodes
+}
+
+// causeOfDeathCode is the LOINC code of the observation that records a patient's cause of
+// death, e.g. as written by Synthea.
+const causeOfDeathCode = "69453-9"
+
+// isCauseOfDeath returns true if the observation o records a patient's cause of death.
+func isCauseOfDeath(o *models.Observation) bool {
+	if o.Code == nil {
+		return false
+	}
+	for _, coding := range o.Code.Coding {
+		if coding.System == "http://loinc.org" && coding.Code == causeOfDeathCode {
+			return true
+		}
+	}
+	return false
+}
+
+// getCauseOfDeath maps the cause of death recorded by the observation o to the condition and
+// disease we track statistics for, the same way as a Condition's codes. If the cause maps
+// to more than one, the first is used. It returns false if o doesn't record a cause of
+// death. The cause is the observation's value, which is the code of the Condition that
+// caused the death: STU3 has no reference from the patient or the observation to the
+// Condition itself.
+func getCauseOfDeath(o *models.Observation, diseases DiseaseMap) (ConditionCode, bool) {
+	if !isCauseOfDeath(o) || o.ValueCodeableConcept == nil {
+		return ConditionCode{}, false
+	}
+	causes := mapCodings(o.ValueCodeableConcept.Coding, diseases)
+	if len(causes) == 0 {
+		return ConditionCode{}, false
+	}
+	return causes[0], true
 }
 
 // SetID sets the BSON ID for the provided resource
@@ -170,23 +508,42 @@ func SetID(model interface{}, id string) {
 	}
 }
 
-func UpdateAllReferences(entries []*models.BundleEntryComponent, refMap map[string]models.Reference) {
-	// First, get all the references by reflecting through the fields of each model
-	var refs []*models.Reference
-	for _, entry := range entries {
-		model := entry.Resource
-		if model != nil {
-			entryRefs := findRefsInValue(reflect.ValueOf(model))
-			refs = append(refs, entryRefs...)
+// SetMeta stamps the resources as version 1, last updated at lastUpdated, the same way the
+// GoFHIR server does when a resource is created. Any other meta data (e.g. profiles and
+// tags) is kept.
+func SetMeta(resources []interface{}, lastUpdated time.Time) {
+	for _, resource := range resources {
+		v := reflect.ValueOf(resource).Elem().FieldByName("Meta")
+		if !v.CanSet() {
+			continue
 		}
-	}
-	// Then iterate through and update as necessary
-	for _, ref := range refs {
-		newRef, found := refMap[ref.Reference]
-		if found {
-			*ref = newRef
+		meta := getMeta(resource)
+		if meta == nil {
+			meta = &models.Meta{}
+			v.Set(reflect.ValueOf(meta))
 		}
+		meta.VersionId = "1"
+		meta.LastUpdated = &models.FHIRDateTime{Time: lastUpdated, Precision: models.Timestamp}
+	}
+}
+
+// getMeta returns the meta data of the provided resource, or nil if it has none
+func getMeta(model interface{}) *models.Meta {
+	v := reflect.ValueOf(model).Elem().FieldByName("Meta")
+	if !v.IsValid() {
+		return nil
+	}
+	meta, _ := v.Interface().(*models.Meta)
+	return meta
+}
+
+// GetID returns the ID of the provided resource
+func GetID(model interface{}) string {
+	v := reflect.ValueOf(model).Elem().FieldByName("Id")
+	if v.Kind() == reflect.String {
+		return v.String()
 	}
+	return ""
 }
 
 func findRefsInValue(val reflect.Value) []*models.Reference {
@@ -0,0 +1,35 @@
+package bulkloader
+
+import "testing"
+
+func TestActiveAt(t *testing.T) {
+	asOf := date("2017-06-01")
+	tests := []struct {
+		name string
+		c    ConditionCode
+		want bool
+	}{
+		{"active", ConditionCode{ClinicalStatus: "active", Onset: datePtr("2010-01-01")}, true},
+		{"no status or dates", ConditionCode{}, true},
+		{"onset after as-of", ConditionCode{ClinicalStatus: "active", Onset: datePtr("2017-06-02")}, false},
+		{"onset on as-of", ConditionCode{Onset: datePtr("2017-06-01")}, true},
+		{"abated before as-of", ConditionCode{Onset: datePtr("2010-01-01"), Abatement: datePtr("2012-01-01")}, false},
+		{"abated after as-of", ConditionCode{Onset: datePtr("2010-01-01"), Abatement: datePtr("2017-07-01")}, true},
+		// the abatement date is used over the clinical status when there is one
+		{"resolved, abated after as-of", ConditionCode{ClinicalStatus: "resolved", Abatement: datePtr("2017-07-01")}, true},
+		{"active, abated before as-of", ConditionCode{ClinicalStatus: "active", Abatement: datePtr("2012-01-01")}, false},
+		{"resolved with no date", ConditionCode{ClinicalStatus: "resolved"}, false},
+		{"inactive with no date", ConditionCode{ClinicalStatus: "inactive"}, false},
+		{"in remission with no date", ConditionCode{ClinicalStatus: "remission"}, false},
+		{"abated with no date", ConditionCode{ClinicalStatus: "active", Abated: true}, false},
+		{"refuted", ConditionCode{ClinicalStatus: "active", VerificationStatus: "refuted"}, false},
+		{"entered in error", ConditionCode{ClinicalStatus: "active", VerificationStatus: "entered-in-error"}, false},
+		{"provisional", ConditionCode{ClinicalStatus: "active", VerificationStatus: "provisional"}, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.c.ActiveAt(asOf); got != tt.want {
+			t.Errorf("%s: ActiveAt = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
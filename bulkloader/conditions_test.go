@@ -0,0 +1,75 @@
+package bulkloader
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+func TestMapCodings(t *testing.T) {
+	diseases := DiseaseMap{
+		{"http://snomed.info/sct", "44054006"}: {ConditionID: 10, DiseaseID: 1},
+		{"http://snomed.info/sct", "38341003"}: {ConditionID: 20, DiseaseID: 2},
+	}
+	tests := []struct {
+		name    string
+		codings []models.Coding
+		want    []ConditionCode
+	}{
+		{name: "no codings"},
+		{
+			name:    "no code",
+			codings: []models.Coding{{System: "http://snomed.info/sct", Display: "Diabetes"}},
+		},
+		{
+			name:    "untracked only",
+			codings: []models.Coding{{System: "http://snomed.info/sct", Code: "1"}, {System: "http://snomed.info/sct", Code: "2"}},
+			want:    []ConditionCode{{System: "http://snomed.info/sct", Code: "1"}},
+		},
+		{
+			name:    "tracked second",
+			codings: []models.Coding{{System: "http://hl7.org/fhir/sid/icd-10", Code: "E11"}, {System: "http://snomed.info/sct", Code: "44054006"}},
+			want:    []ConditionCode{{System: "http://snomed.info/sct", Code: "44054006", ConditionID: 10, DiseaseID: 1}},
+		},
+		{
+			name:    "several tracked",
+			codings: []models.Coding{{System: "http://snomed.info/sct", Code: "44054006"}, {System: "http://snomed.info/sct", Code: "38341003"}},
+			want: []ConditionCode{
+				{System: "http://snomed.info/sct", Code: "44054006", ConditionID: 10, DiseaseID: 1},
+				{System: "http://snomed.info/sct", Code: "38341003", ConditionID: 20, DiseaseID: 2},
+			},
+		},
+		{
+			name:    "code without its system",
+			codings: []models.Coding{{Code: "44054006"}},
+			want:    []ConditionCode{{Code: "44054006"}},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := mapCodings(tt.codings, diseases); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetConditionCodesNoCode(t *testing.T) {
+	tests := []struct {
+		name string
+		code *models.CodeableConcept
+	}{
+		{"no code", nil},
+		{"no codings", &models.CodeableConcept{Text: "Diabetes"}},
+		{"empty codings", &models.CodeableConcept{Coding: []models.Coding{}}},
+		{"codings without codes", &models.CodeableConcept{Coding: []models.Coding{{System: "http://snomed.info/sct", Display: "Diabetes"}}}},
+	}
+
+	for _, tt := range tests {
+		c := &models.Condition{Code: tt.code}
+		c.Id = "c1"
+		if condcodes, err := getConditionCodes(c, DiseaseMap{}); err == nil {
+			t.Errorf("%s: got %+v, want an error", tt.name, condcodes)
+		}
+	}
+}
@@ -2,7 +2,9 @@ package bulkloader
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"time"
 
 	"github.com/lib/pq"
 	"gopkg.in/mgo.v2"
@@ -28,6 +30,7 @@ type commonResID struct {
 	AgeRange    int    `bson:"AgeRange"`
 	DiseaseID   int    `bson:"DiseaseID,omitempty"`
 	ConditionID int    `bson:"ConditionID,omitempty"`
+	DeathYear   int    `bson:"DeathYear,omitempty"`
 }
 
 type commonResults struct {
@@ -37,65 +40,194 @@ type commonResults struct {
 	PopFemale int32       `bson:"pop_female"`
 }
 
-// ClearFactTables clears the facts tables in Postgres so they can be reloaded
-// with new statistics from the uploaded FHIR bundles. This action is disabled
-// by default and can be enabled with the -reset flag.
-func ClearFactTables(db *sql.DB) {
-	log.Println("[WARNING] Clearing statistics in Postgres")
-	_, err := db.Query(`truncate table synth_ma.synth_condition_facts;`)
-	if err != nil {
-		log.Println("Couldn't truncate synth_ma.synth_condition_facts")
+// FactTables calculates the statistics in the Postgres fact tables from the documents in
+// the rawstat collection.
+type FactTables struct {
+	Session *mgo.Session
+	DBName  string
+	DB      *sql.DB
+	Retry   RetryPolicy
+	Schema  Schema
+}
+
+// factCalculation calculates the statistics in a fact table.
+type factCalculation struct {
+	table     string
+	calculate func() error
+}
+
+// factTables returns the calculations of the fact tables that exist in the schema. The
+// mortality and active facts are optional, since schemas created by hand, e.g. from the
+// pgstats repo, may not have the tables.
+func (f *FactTables) factTables() ([]factCalculation, error) {
+	calculations := []factCalculation{
+		{f.Schema.PopFacts, f.CalculatePopulationFacts},
+		{f.Schema.DiseaseFacts, f.CalculateDiseaseFacts},
+		{f.Schema.ConditionFacts, f.CalculateConditionFacts},
 	}
 
-	_, err = db.Query(`truncate table synth_ma.synth_disease_facts;`)
-	if err != nil {
-		log.Println("Couldn't truncate synth_ma.synth_disease_facts")
+	optional := []factCalculation{
+		{f.Schema.ActiveDiseaseFacts, f.CalculateActiveDiseaseFacts},
+		{f.Schema.ActiveConditionFacts, f.CalculateActiveConditionFacts},
+		{f.Schema.MortalityFacts, f.CalculateMortalityFacts},
 	}
+	for _, c := range optional {
+		var exists bool
+		err := f.DB.QueryRow(`select to_regclass($1) is not null`, f.Schema.Table(c.table)).Scan(&exists)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			calculations = append(calculations, c)
+		} else {
+			log.Printf("[WARNING] There is no %s.%s table, skipping its statistics\n", f.Schema.Name, c.table)
+		}
+	}
+	return calculations, nil
+}
 
-	_, err = db.Query(`truncate table synth_ma.synth_pop_facts;`)
+// stagingTable returns the name of the staging table the new facts for a fact table are
+// calculated into.
+func stagingTable(table string) string {
+	return table + "_staging"
+}
+
+// Calculate calculates all of the statistics into staging tables, and then replaces the
+// facts in the fact tables with them in a single transaction. Until then, and if any of
+// the calculations fail, the fact tables keep their old facts.
+func (f *FactTables) Calculate() error {
+	start := time.Now()
+
+	calculations, err := f.factTables()
 	if err != nil {
-		log.Println("Couldn't truncate synth_ma.synth_pop_facts")
+		return err
+	}
+
+	if err = f.createStagingTables(calculations); err != nil {
+		return fmt.Errorf("failed to create the staging tables: %s", err)
+	}
+	defer f.dropStagingTables(calculations)
+
+	for _, c := range calculations {
+		if err = c.calculate(); err != nil {
+			return err
+		}
+		log.Printf("Time elapsed: %f seconds\n", time.Since(start).Seconds())
+	}
+
+	log.Println("Replacing the statistics in Postgres...")
+	return f.Retry.Do("Replacing the statistics", func(attempt int) error {
+		txn, err := f.DB.Begin()
+		if err != nil {
+			return err
+		}
+		// a no-op once the transaction is committed
+		defer txn.Rollback()
+
+		for _, c := range calculations {
+			if _, err = txn.Exec(`delete from ` + f.Schema.Table(c.table)); err != nil {
+				return err
+			}
+			_, err = txn.Exec(`insert into ` + f.Schema.Table(c.table) + ` select * from ` + f.Schema.Table(stagingTable(c.table)))
+			if err != nil {
+				return err
+			}
+		}
+		return txn.Commit()
+	})
+}
+
+// createStagingTables creates an empty staging table like each fact table.
+func (f *FactTables) createStagingTables(calculations []factCalculation) error {
+	return f.Retry.Do("Creating the staging tables", func(attempt int) error {
+		for _, c := range calculations {
+			staging := f.Schema.Table(stagingTable(c.table))
+			_, err := f.DB.Exec(`drop table if exists ` + staging + `;
+				create unlogged table ` + staging + ` (like ` + f.Schema.Table(c.table) + ` including defaults)`)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// dropStagingTables drops the staging tables.
+func (f *FactTables) dropStagingTables(calculations []factCalculation) {
+	for _, c := range calculations {
+		if _, err := f.DB.Exec(`drop table if exists ` + f.Schema.Table(stagingTable(c.table))); err != nil {
+			log.Printf("Failed to drop the staging table %s: %s\n", stagingTable(c.table), err)
+		}
 	}
 }
 
-// ClearMongoCollections clears the relevant collections in Mongo. This action is
-// disabled by default and can be enabled with the -reset flag.
-func ClearMongoCollections(mongoSession *mgo.Session, dbName string) {
+// ClearMongoCollections clears the collections written by previous loads, as recorded in
+// their manifests, along with the manifests themselves. If all is true, the collections of
+// every FHIR resource type are cleared too. This action is disabled by default and can be
+// enabled with the -reset (or -reset-all) flag. It returns an error, without dropping any
+// collections, if it can't tell which collections there are to drop.
+func ClearMongoCollections(mongoSession *mgo.Session, dbName string, all bool) error {
 	log.Println("[WARNING] Clearing collections in Mongo")
 
 	session := mongoSession.Copy()
 	defer session.Close()
 
-	for _, name := range collectionNames {
+	// drop the collections written by previous loads, and the default collections in case
+	// they were written by loads from before there was a manifest
+	names := append([]string{}, collectionNames...)
+	recorded, err := manifestCollections(session, dbName)
+	if err != nil {
+		return fmt.Errorf("failed to read the collections written by previous loads: %s", err)
+	}
+	names = append(names, recorded...)
+	if all {
+		names = append(names, allResourceCollections()...)
+	}
+
+	existing, err := session.DB(dbName).CollectionNames()
+	if err != nil {
+		return fmt.Errorf("failed to list the collections in Mongo: %s", err)
+	}
+	exists := make(map[string]bool)
+	for _, name := range existing {
+		exists[name] = true
+	}
+
+	for _, name := range append(names, manifestCollection) {
+		if !exists[name] {
+			continue
+		}
+		// only drop each collection once
+		exists[name] = false
+
 		err := session.DB(dbName).C(name).DropCollection()
 		if err != nil {
 			log.Printf("Failed to drop collection '%s'\n", name)
 		}
 	}
+	return nil
 }
 
-// CalculatePopulationFacts calculates the basic population facts for each subdivision.
-// This only counts living patients.
-func CalculatePopulationFacts(mongoSession *mgo.Session, dbName string, db *sql.DB) {
-
-	log.Println("Calculating population statistics...")
+// matchPatients returns a $match stage for the rawstat documents matching query that have
+// their patient's demographics. An NDJSON load adds a patient's conditions and cause of
+// death to the patient's document even if the patient was left out of the statistics (e.g.
+// because their age isn't in any age band), which leaves a document with no agerange.
+func matchPatients(query bson.M) bson.M {
+	query["agerange"] = bson.M{"$exists": true}
+	return bson.M{"$match": query}
+}
 
-	// copy the mongo session
-	session := mongoSession.Copy()
-	defer session.Close()
+// CalculatePopulationFacts calculates the basic population facts for each subdivision
+// into the staging table. This only counts living patients.
+func (f *FactTables) CalculatePopulationFacts() error {
 
-	// check that we're still connected to Postgres
-	if err := db.Ping(); err != nil {
-		log.Fatal("Lost connection to Postgres")
-	}
+	log.Println("Calculating population statistics...")
 
-	c := session.DB(dbName).C("rawstat")
 	pipeline := []bson.M{
-		bson.M{"$match": bson.M{"$or": []interface{}{
+		matchPatients(bson.M{"$or": []interface{}{
 			bson.M{"deceasedboolean": bson.M{"$exists": false}},
 			bson.M{"deceasedboolean": false},
-		}},
-		},
+		}}),
 		bson.M{
 			"$project": bson.M{
 				"_id":                       0,
@@ -126,77 +258,48 @@ func CalculatePopulationFacts(mongoSession *mgo.Session, dbName string, db *sql.
 		},
 	}
 
-	pipe := c.Pipe(pipeline)
-	iter := pipe.Iter()
-
-	log.Println("Adding stats to Postgres...")
-
-	txn, err := db.Begin()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	stmt, err := txn.Prepare(pq.CopyInSchema("synth_ma", "synth_pop_facts", "cs_fips", "age_id", "pop", "pop_male", "pop_female"))
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	result := commonResults{}
-
-	for iter.Next(&result) {
-		_, err = stmt.Exec(result.ID.CsFips, result.ID.AgeRange, result.Pop, result.PopMale, result.PopFemale)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
-
-	_,err = stmt.Exec()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	err = stmt.Close()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	err = txn.Commit()
-	if err != nil {
-		log.Fatal(err)
-	}
+	return f.copyFacts(pipeline, stagingTable(f.Schema.PopFacts),
+		[]string{"cs_fips", "age_id", "pop", "pop_male", "pop_female"},
+		func(result commonResults) []interface{} {
+			return []interface{}{result.ID.CsFips, result.ID.AgeRange, result.Pop, result.PopMale, result.PopFemale}
+		})
 }
 
-// CalculateDiseaseFacts calculates the populations for each disease we track statistics for.
-// This only counts living patients. A patient is counted only once per disease.
-func CalculateDiseaseFacts(mongoSession *mgo.Session, dbName string, db *sql.DB) {
-
+// CalculateDiseaseFacts calculates the populations for each disease we track statistics for
+// into the staging table, counting every patient ever diagnosed with the disease. This only
+// counts living patients. A patient is counted only once per disease.
+func (f *FactTables) CalculateDiseaseFacts() error {
 	log.Println("Calculating disease statistics...")
+	return f.calculateDiseaseFacts("uniquediseases", f.Schema.DiseaseFacts)
+}
 
-	// copy the mongo session
-	session := mongoSession.Copy()
-	defer session.Close()
+// CalculateActiveDiseaseFacts calculates the populations for each disease we track
+// statistics for into the staging table, counting only the patients who had the disease
+// as of the as-of date of the load. This only counts living patients. A patient is counted
+// only once per disease.
+func (f *FactTables) CalculateActiveDiseaseFacts() error {
+	log.Println("Calculating active disease statistics...")
+	return f.calculateDiseaseFacts("activediseases", f.Schema.ActiveDiseaseFacts)
+}
 
-	// check that we're still connected to Postgres
-	if err := db.Ping(); err != nil {
-		log.Fatal("Lost connection to Postgres")
-	}
+// calculateDiseaseFacts calculates the populations for each disease in the rawstat field
+// into the staging table of a fact table.
+func (f *FactTables) calculateDiseaseFacts(field, table string) error {
 
-	c := session.DB(dbName).C("rawstat")
 	pipeline := []bson.M{
-		bson.M{"$match": bson.M{"$or": []interface{}{
+		matchPatients(bson.M{"$or": []interface{}{
 			bson.M{"deceasedboolean": bson.M{"$exists": false}},
 			bson.M{"deceasedboolean": false},
-		}},
-		},
-		bson.M{"$unwind": "$uniquediseases"},
-		bson.M{"$match": bson.M{"uniquediseases": bson.M{"$gt": 0}}},
+		}}),
+		bson.M{"$unwind": "$" + field},
+		bson.M{"$match": bson.M{field: bson.M{"$gt": 0}}},
 		bson.M{
 			"$project": bson.M{
 				"_id":                       0,
 				"gender":                    1,
 				"agerange":                  1,
 				"location.subcountyid_fips": 1,
-				"uniquediseases":            1,
+				field:                       1,
 				"male": bson.M{"$cond": []interface{}{
 					bson.M{"$eq": []interface{}{"$gender", "male"}},
 					1,
@@ -213,7 +316,7 @@ func CalculateDiseaseFacts(mongoSession *mgo.Session, dbName string, db *sql.DB)
 			"$group": bson.M{
 				"_id": bson.M{
 					"CsFips":    "$location.subcountyid_fips",
-					"DiseaseID": "$uniquediseases",
+					"DiseaseID": "$" + field,
 					"AgeRange":  "$agerange"},
 				"pop":        bson.M{"$sum": 1},
 				"pop_male":   bson.M{"$sum": "$male"},
@@ -222,76 +325,48 @@ func CalculateDiseaseFacts(mongoSession *mgo.Session, dbName string, db *sql.DB)
 		},
 	}
 
-	pipe := c.Pipe(pipeline)
-	iter := pipe.Iter()
-
-	log.Println("Adding stats to Postgres...")
-
-	txn, err := db.Begin()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	stmt, err := txn.Prepare(pq.CopyInSchema("synth_ma", "synth_disease_facts", "cs_fips", "disease_id", "age_id", "pop", "pop_male", "pop_female"))
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	result := commonResults{}
-
-	for iter.Next(&result) {
-		_, err = stmt.Exec(result.ID.CsFips, result.ID.DiseaseID, result.ID.AgeRange, result.Pop, result.PopMale, result.PopFemale)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
-	_,err = stmt.Exec()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	err = stmt.Close()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	err = txn.Commit()
-	if err != nil {
-		log.Fatal(err)
-	}
+	return f.copyFacts(pipeline, stagingTable(table),
+		[]string{"cs_fips", "disease_id", "age_id", "pop", "pop_male", "pop_female"},
+		func(result commonResults) []interface{} {
+			return []interface{}{result.ID.CsFips, result.ID.DiseaseID, result.ID.AgeRange, result.Pop, result.PopMale, result.PopFemale}
+		})
 }
 
-// CalculateConditionFacts calculates the populations broken down by condition.
-// This only counts living patients. A patient is counted only once per condition.
-func CalculateConditionFacts(mongoSession *mgo.Session, dbName string, db *sql.DB) {
-
+// CalculateConditionFacts calculates the populations broken down by condition into the
+// staging table, counting every patient ever diagnosed with the condition. This only
+// counts living patients. A patient is counted only once per condition.
+func (f *FactTables) CalculateConditionFacts() error {
 	log.Println("Calculating condition statistics...")
+	return f.calculateConditionFacts("uniqueconditions", f.Schema.ConditionFacts)
+}
 
-	// copy the mongo session
-	session := mongoSession.Copy()
-	defer session.Close()
+// CalculateActiveConditionFacts calculates the populations broken down by condition into
+// the staging table, counting only the patients who had the condition as of the as-of date
+// of the load. This only counts living patients. A patient is counted only once per
+// condition.
+func (f *FactTables) CalculateActiveConditionFacts() error {
+	log.Println("Calculating active condition statistics...")
+	return f.calculateConditionFacts("activeconditions", f.Schema.ActiveConditionFacts)
+}
 
-	// check that we're still connected to Postgres
-	if err := db.Ping(); err != nil {
-		log.Fatal("Lost connection to Postgres")
-	}
+// calculateConditionFacts calculates the populations for each condition in the rawstat
+// field into the staging table of a fact table.
+func (f *FactTables) calculateConditionFacts(field, table string) error {
 
-	c := session.DB(dbName).C("rawstat")
 	pipeline := []bson.M{
-		bson.M{"$match": bson.M{"$or": []interface{}{
+		matchPatients(bson.M{"$or": []interface{}{
 			bson.M{"deceasedboolean": bson.M{"$exists": false}},
 			bson.M{"deceasedboolean": false},
-		}},
-		},
-		bson.M{"$unwind": "$uniqueconditions"},
-		bson.M{"$match": bson.M{"uniqueconditions": bson.M{"$gt": 0}}},
+		}}),
+		bson.M{"$unwind": "$" + field},
+		bson.M{"$match": bson.M{field: bson.M{"$gt": 0}}},
 		bson.M{
 			"$project": bson.M{
 				"_id":                       0,
 				"gender":                    1,
 				"agerange":                  1,
 				"location.subcountyid_fips": 1,
-				"uniqueconditions":          1,
+				field:                       1,
 				"male": bson.M{"$cond": []interface{}{
 					bson.M{"$eq": []interface{}{"$gender", "male"}},
 					1,
@@ -308,7 +383,7 @@ func CalculateConditionFacts(mongoSession *mgo.Session, dbName string, db *sql.D
 			"$group": bson.M{
 				"_id": bson.M{
 					"CsFips":      "$location.subcountyid_fips",
-					"ConditionID": "$uniqueconditions",
+					"ConditionID": "$" + field,
 					"AgeRange":    "$agerange"},
 				"pop":        bson.M{"$sum": 1},
 				"pop_male":   bson.M{"$sum": "$male"},
@@ -317,42 +392,133 @@ func CalculateConditionFacts(mongoSession *mgo.Session, dbName string, db *sql.D
 		},
 	}
 
-	pipe := c.Pipe(pipeline)
-	iter := pipe.Iter()
+	return f.copyFacts(pipeline, stagingTable(table),
+		[]string{"cs_fips", "condition_id", "age_id", "pop", "pop_male", "pop_female"},
+		func(result commonResults) []interface{} {
+			return []interface{}{result.ID.CsFips, result.ID.ConditionID, result.ID.AgeRange, result.Pop, result.PopMale, result.PopFemale}
+		})
+}
 
-	log.Println("Adding stats to Postgres...")
+// CalculateMortalityFacts calculates the deaths in each subdivision, broken down by age at
+// death, year of death and the disease that caused the death, into the staging table. The
+// year and disease are null for deaths where they aren't known, or the cause of death isn't
+// a disease we track statistics for.
+func (f *FactTables) CalculateMortalityFacts() error {
 
-	txn, err := db.Begin()
-	if err != nil {
-		log.Fatal(err)
+	log.Println("Calculating mortality statistics...")
+
+	pipeline := []bson.M{
+		matchPatients(bson.M{"deceasedboolean": true}),
+		bson.M{
+			"$project": bson.M{
+				"_id":                       0,
+				"gender":                    1,
+				"agerange":                  1,
+				"location.subcountyid_fips": 1,
+				"deathyear":                 1,
+				"causeofdeath.diseaseid":    1,
+				"male": bson.M{"$cond": []interface{}{
+					bson.M{"$eq": []interface{}{"$gender", "male"}},
+					1,
+					0,
+				}},
+				"female": bson.M{"$cond": []interface{}{
+					bson.M{"$eq": []interface{}{"$gender", "female"}},
+					1,
+					0,
+				}},
+			},
+		},
+		bson.M{
+			"$group": bson.M{
+				"_id": bson.M{
+					"CsFips":    "$location.subcountyid_fips",
+					"AgeRange":  "$agerange",
+					"DeathYear": "$deathyear",
+					"DiseaseID": "$causeofdeath.diseaseid"},
+				"pop":        bson.M{"$sum": 1},
+				"pop_male":   bson.M{"$sum": "$male"},
+				"pop_female": bson.M{"$sum": "$female"},
+			},
+		},
 	}
 
-	stmt, err := txn.Prepare(pq.CopyInSchema("synth_ma", "synth_condition_facts", "cs_fips", "condition_id", "age_id", "pop", "pop_male", "pop_female"))
-	if err != nil {
-		log.Fatal(err)
+	return f.copyFacts(pipeline, stagingTable(f.Schema.MortalityFacts),
+		[]string{"cs_fips", "age_id", "death_year", "disease_id", "pop", "pop_male", "pop_female"},
+		func(result commonResults) []interface{} {
+			return []interface{}{result.ID.CsFips, result.ID.AgeRange, nullID(result.ID.DeathYear), nullID(result.ID.DiseaseID), result.Pop, result.PopMale, result.PopFemale}
+		})
+}
+
+// nullID returns nil (i.e. null) for an ID that isn't known, or isn't tracked, and the ID
+// otherwise.
+func nullID(id int) interface{} {
+	if id <= 0 {
+		return nil
 	}
+	return id
+}
+
+// copyFacts runs an aggregation pipeline on the rawstat collection and copies the row
+// returned by values for each result into a fact table in Postgres, in a single
+// transaction. If either database fails with a transient error the whole operation is
+// retried; the transaction is rolled back first, so no facts are copied twice.
+func (f *FactTables) copyFacts(pipeline []bson.M, table string, columns []string, values func(commonResults) []interface{}) error {
+
+	// copy the mongo session
+	session := f.Session.Copy()
+	defer session.Close()
+
+	return f.Retry.DoMongo(session, "Adding stats to "+table, func(attempt int) error {
+
+		// check that we're still connected to Postgres
+		if err := f.DB.Ping(); err != nil {
+			return err
+		}
+
+		c := session.DB(f.DBName).C("rawstat")
+		pipe := c.Pipe(pipeline)
+		iter := pipe.Iter()
+		defer iter.Close()
 
-	result := commonResults{}
+		log.Println("Adding stats to Postgres...")
 
-	for iter.Next(&result) {
-		_, err = stmt.Exec(result.ID.CsFips, result.ID.ConditionID, result.ID.AgeRange, result.Pop, result.PopMale, result.PopFemale)
+		txn, err := f.DB.Begin()
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-	}
+		// a no-op once the transaction is committed
+		defer txn.Rollback()
 
-	_,err = stmt.Exec()
-	if err != nil {
-		log.Fatal(err)
-	}
+		stmt, err := txn.Prepare(pq.CopyInSchema(f.Schema.Name, table, columns...))
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
 
-	err = stmt.Close()
-	if err != nil {
-		log.Fatal(err)
-	}
+		result := commonResults{}
 
-	err = txn.Commit()
-	if err != nil {
-		log.Fatal(err)
-	}
+		for iter.Next(&result) {
+			_, err = stmt.Exec(values(result)...)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err = iter.Err(); err != nil {
+			return err
+		}
+
+		_, err = stmt.Exec()
+		if err != nil {
+			return err
+		}
+
+		err = stmt.Close()
+		if err != nil {
+			return err
+		}
+
+		return txn.Commit()
+	})
 }
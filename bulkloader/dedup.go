@@ -0,0 +1,299 @@
+package bulkloader
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DefaultDedupKeys are the natural keys used to deduplicate the shared resources that every
+// Synthea bundle carries its own copy of. A key is an identifier system, "identifier" for a
+// resource's first identifier whatever its system, or "name" for the resource's name.
+var DefaultDedupKeys = map[string]string{
+	"Practitioner": "http://hl7.org/fhir/sid/us-npi",
+	"Organization": "identifier",
+	"Location":     "identifier",
+}
+
+// ParseDedupKeys parses a comma-separated list of "Type=key" natural keys, e.g.
+// "Practitioner=http://hl7.org/fhir/sid/us-npi,Location=name", over the DefaultDedupKeys.
+func ParseDedupKeys(s string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for resourceType, key := range DefaultDedupKeys {
+		keys[resourceType] = key
+	}
+	if s == "" {
+		return keys, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid dedup key '%s', expected Type=key", pair)
+		}
+		if parts[1] == "name" && parts[0] != "Organization" && parts[0] != "Location" {
+			return nil, fmt.Errorf("only Organizations and Locations can be deduplicated by name")
+		}
+		keys[parts[0]] = parts[1]
+	}
+	return keys, nil
+}
+
+// dedupEntry is the canonical copy of a shared resource. Its fields are guarded by mu, so
+// that looking the resource up in Mongo only holds up the bundles that have a copy of it.
+type dedupEntry struct {
+	mu sync.Mutex
+	// found is true once the ID has been looked up in Mongo.
+	found bool
+	id    string
+	// owned is true while a bundle is uploading the canonical copy, or once it (or a
+	// previous load) has. If the bundle fails, the next bundle with a copy uploads it.
+	owned bool
+	// released is the copy from the last bundle that failed to upload it, which is uploaded
+	// on its own at the end of the load if no later bundle has a copy.
+	released interface{}
+}
+
+// DedupClaim is a canonical copy of a shared resource that a bundle is responsible for
+// uploading.
+type DedupClaim struct {
+	entry    *dedupEntry
+	resource interface{}
+}
+
+// DedupRegistry maps the natural keys of shared resources (Practitioners, Organizations
+// and Locations) to the ID of their canonical copy. The first copy of a resource is
+// uploaded, and the later copies in other bundles are dropped and the references to them
+// rewritten to the canonical ID. A DedupRegistry is shared by all workers.
+type DedupRegistry struct {
+	mu       sync.Mutex // guards entries and counts
+	uploader *Uploader
+	keys     map[string]string // natural key by resource type
+	strategy IDStrategy
+	entries  map[string]*dedupEntry
+	counts   map[string]int // duplicates dropped by resource type
+}
+
+// NewDedupRegistry returns an empty DedupRegistry for the resource types in keys. Resources
+// loaded by previous runs are looked up in Mongo using the Uploader's session.
+func (u *Uploader) NewDedupRegistry(keys map[string]string, strategy IDStrategy) *DedupRegistry {
+	return &DedupRegistry{
+		uploader: u,
+		keys:     keys,
+		strategy: strategy,
+		entries:  make(map[string]*dedupEntry),
+		counts:   make(map[string]int),
+	}
+}
+
+// Canonical returns the canonical ID of a resource that is to be given id. If the resource
+// isn't a shared one, or has no natural key, id is returned as it is and claim is nil. If
+// this is the first copy of the resource, a claim is returned and the resource should be
+// uploaded. Otherwise duplicate is true, and the resource shouldn't be uploaded.
+func (r *DedupRegistry) Canonical(resource interface{}, id string) (canonical string, claim *DedupClaim, duplicate bool, err error) {
+	resourceType := reflect.TypeOf(resource).Elem().Name()
+	naturalKey := r.naturalKey(resourceType, resource)
+	if naturalKey == "" {
+		return id, nil, false, nil
+	}
+	key := resourceType + "|" + naturalKey
+
+	r.mu.Lock()
+	entry, ok := r.entries[key]
+	if !ok {
+		entry = &dedupEntry{}
+		r.entries[key] = entry
+	}
+	r.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	if !entry.found {
+		// the first copy in this load, but a previous load may have uploaded one already
+		existing, err := r.findExisting(resourceType, naturalKey)
+		if err != nil {
+			return "", nil, false, err
+		}
+		switch {
+		case existing != "":
+			// tag the previous load's copy with this run too, so rolling back either run
+			// leaves it for the other
+			if err = r.shareExisting(resourceType, existing); err != nil {
+				return "", nil, false, err
+			}
+			entry.id, entry.owned = existing, true
+		case r.strategy == DeterministicIDs:
+			entry.id = DeterministicID(resourceType, naturalKey)
+		default:
+			entry.id = id
+		}
+		entry.found = true
+	}
+
+	if !entry.owned {
+		entry.owned = true
+		entry.released = nil
+		return entry.id, &DedupClaim{entry, resource}, false, nil
+	}
+
+	r.mu.Lock()
+	r.counts[resourceType]++
+	r.mu.Unlock()
+	return entry.id, nil, true, nil
+}
+
+// Release gives up the claims of a bundle that failed to load, so the canonical copies are
+// uploaded by the next bundles that have them instead. They keep the same IDs, so references
+// that have already been rewritten to them will resolve.
+func (r *DedupRegistry) Release(claims []*DedupClaim) {
+	for _, claim := range claims {
+		claim.entry.mu.Lock()
+		claim.entry.owned = false
+		claim.entry.released = claim.resource
+		claim.entry.mu.Unlock()
+	}
+}
+
+// UploadReleased uploads the canonical copies that were released by bundles that failed to
+// load and weren't in any later bundle, so that the references already rewritten to them
+// resolve. The copies are uploaded as they were in the failed bundles. It returns the number
+// of copies uploaded.
+func (r *DedupRegistry) UploadReleased() (int, error) {
+	r.mu.Lock()
+	var entries []*dedupEntry
+	for _, entry := range r.entries {
+		entries = append(entries, entry)
+	}
+	r.mu.Unlock()
+
+	var resources []interface{}
+	for _, entry := range entries {
+		entry.mu.Lock()
+		if !entry.owned && entry.released != nil {
+			resources = append(resources, entry.released)
+			entry.owned, entry.released = true, nil
+		}
+		entry.mu.Unlock()
+	}
+	if len(resources) == 0 {
+		return 0, nil
+	}
+
+	session := r.uploader.Session.Copy()
+	defer session.Close()
+
+	SetMeta(resources, time.Now())
+	TagRun(resources, r.uploader.runID())
+	if err := r.uploader.insertResources(session, resources); err != nil {
+		return 0, err
+	}
+	return len(resources), nil
+}
+
+// Counts returns the number of duplicates dropped for each resource type.
+func (r *DedupRegistry) Counts() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	counts := make(map[string]int)
+	for resourceType, n := range r.counts {
+		counts[resourceType] = n
+	}
+	return counts
+}
+
+// Summary returns a one line summary of the duplicates dropped.
+func (r *DedupRegistry) Summary() string {
+	counts := r.Counts()
+
+	var parts []string
+	for _, resourceType := range sortedKeys(counts) {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[resourceType], resourceType))
+	}
+	if len(parts) == 0 {
+		return "No duplicate shared resources"
+	}
+	return "Deduplicated " + strings.Join(parts, ", ")
+}
+
+// naturalKey returns the natural key of a resource of resourceType, or "" if the resource
+// type isn't deduplicated or the resource has no key.
+func (r *DedupRegistry) naturalKey(resourceType string, resource interface{}) string {
+	switch keyType, ok := r.keys[resourceType]; {
+	case !ok:
+		return ""
+	case keyType == "name":
+		if name := reflect.ValueOf(resource).Elem().FieldByName("Name"); name.Kind() == reflect.String {
+			return name.String()
+		}
+		return ""
+	default:
+		for _, identifier := range identifiersOf(resource) {
+			if identifier.Value != "" && (keyType == "identifier" || identifier.System == keyType) {
+				return identifier.System + "|" + identifier.Value
+			}
+		}
+		return ""
+	}
+}
+
+// shareExisting adds this run's tag to a canonical copy uploaded by a previous load, which
+// this run's resources will reference. Rollback deletes a resource only if it isn't tagged
+// with any other run.
+func (r *DedupRegistry) shareExisting(resourceType, id string) error {
+	runID := r.uploader.runID()
+	if runID == "" {
+		return nil
+	}
+	collection := models.PluralizeLowerResourceName(resourceType)
+	if err := r.uploader.recordCollection(collection); err != nil {
+		return err
+	}
+
+	session := r.uploader.Session.Copy()
+	defer session.Close()
+
+	c := session.DB(r.uploader.DBName).C(collection)
+	tag := bson.D{{Name: "system", Value: RunTagSystem}, {Name: "code", Value: runID}}
+	return r.uploader.Retry.DoMongo(session, "Tagging "+collection, func(attempt int) error {
+		// adding the tag again is a no-op, so it can simply be run again
+		return c.UpdateId(id, bson.M{"$addToSet": bson.M{"meta.tag": tag}})
+	})
+}
+
+// findExisting returns the ID of a resource with the natural key that is already in Mongo,
+// or "" if there isn't one.
+func (r *DedupRegistry) findExisting(resourceType, naturalKey string) (string, error) {
+	var selector bson.M
+	if r.keys[resourceType] == "name" {
+		selector = bson.M{"name": naturalKey}
+	} else {
+		parts := strings.SplitN(naturalKey, "|", 2)
+		identifier := bson.M{"value": parts[1]}
+		if parts[0] != "" {
+			identifier["system"] = parts[0]
+		}
+		selector = bson.M{"identifier": bson.M{"$elemMatch": identifier}}
+	}
+
+	session := r.uploader.Session.Copy()
+	defer session.Close()
+
+	var existing []struct {
+		ID string `bson:"_id"`
+	}
+	c := session.DB(r.uploader.DBName).C(models.PluralizeLowerResourceName(resourceType))
+	err := r.uploader.Retry.DoMongo(session, "Searching "+c.Name, func(attempt int) error {
+		return c.Find(selector).Select(bson.M{"_id": 1}).Limit(1).All(&existing)
+	})
+	if err != nil || len(existing) == 0 {
+		return "", err
+	}
+	return existing[0].ID, nil
+}
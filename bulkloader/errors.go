@@ -0,0 +1,158 @@
+package bulkloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// Stage is the stage of loading a bundle at which it failed.
+type Stage string
+
+const (
+	// StageRead is opening or reading the bundle file.
+	StageRead Stage = "read"
+	// StageDecode is decoding the bundle's JSON.
+	StageDecode Stage = "decode"
+	// StageReference is assigning new IDs and rewriting the references between resources.
+	StageReference Stage = "reference"
+	// StageID is checking that preserved IDs aren't already in Mongo.
+	StageID Stage = "id"
+	// StageMongo is writing the resources and their statistics to Mongo.
+	StageMongo Stage = "mongo"
+	// StageStats is extracting the statistics for the rawstat collection.
+	StageStats Stage = "stats"
+)
+
+// BundleError is an error that caused a bundle, or a resource in an NDJSON file, to fail
+// to load.
+type BundleError struct {
+	Path  string
+	Stage Stage
+	Err   error
+}
+
+func (e *BundleError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%s: %s", e.Stage, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Path, e.Stage, e.Err)
+}
+
+// MarshalJSON writes the error in the form used by the failure report.
+func (e *BundleError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Path    string `json:"path"`
+		Stage   Stage  `json:"stage"`
+		Message string `json:"message"`
+	}{e.Path, e.Stage, e.Err.Error()})
+}
+
+// stageError returns err as a BundleError at the given stage. The path is filled in by
+// the caller, who knows which bundle it was loading.
+func stageError(stage Stage, err error) *BundleError {
+	return &BundleError{Stage: stage, Err: err}
+}
+
+// ErrorReport records how many bundles were loaded and why the others failed. When loading
+// NDJSON files it counts resources instead of bundles. An ErrorReport is safe for use by
+// multiple workers at once.
+type ErrorReport struct {
+	mu        sync.Mutex
+	RunID     string         `json:"runId,omitempty"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	Failures  []*BundleError `json:"failures"`
+	// Warnings are problems in bundles that loaded anyway, e.g. unresolved references.
+	Warnings []*BundleError `json:"warnings"`
+	// Deduplicated is the number of copies of shared resources that weren't uploaded, by
+	// resource type.
+	Deduplicated map[string]int `json:"deduplicated,omitempty"`
+
+	failedByStage map[Stage]int
+}
+
+// NewErrorReport returns an empty ErrorReport.
+func NewErrorReport() *ErrorReport {
+	return &ErrorReport{Failures: []*BundleError{}, Warnings: []*BundleError{}, failedByStage: make(map[Stage]int)}
+}
+
+// Success records n bundles (or NDJSON resources) that loaded successfully.
+func (r *ErrorReport) Success(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Succeeded += n
+}
+
+// Failure records the failure of the bundle (or NDJSON resource) at path and returns it as
+// a BundleError. If err isn't already a BundleError it's recorded as failing at the given
+// stage.
+func (r *ErrorReport) Failure(path string, stage Stage, err error) *BundleError {
+	return r.BatchFailure(path, stage, err, 1)
+}
+
+// BatchFailure records the failure of a batch of n NDJSON resources at path, counting each
+// of the resources as failed, so that the counts in an NDJSON load are all of resources.
+func (r *ErrorReport) BatchFailure(path string, stage Stage, err error, n int) *BundleError {
+	berr, ok := err.(*BundleError)
+	if !ok {
+		berr = stageError(stage, err)
+	}
+	berr.Path = path
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Failed += n
+	r.failedByStage[berr.Stage] += n
+	r.Failures = append(r.Failures, berr)
+	return berr
+}
+
+// Warning records a problem in the bundle at path that didn't stop it loading, and returns
+// it as a BundleError.
+func (r *ErrorReport) Warning(path string, stage Stage, err error) *BundleError {
+	berr := &BundleError{Path: path, Stage: stage, Err: err}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Warnings = append(r.Warnings, berr)
+	return berr
+}
+
+// Counts returns the number of bundles (or NDJSON resources) that loaded and failed so far,
+// and the number of warnings.
+func (r *ErrorReport) Counts() (succeeded, failed, warnings int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Succeeded, r.Failed, len(r.Warnings)
+}
+
+// WriteJSON writes the report to a JSON file at path.
+func (r *ErrorReport) WriteJSON(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Summary returns a one line summary of the report.
+func (r *ErrorReport) Summary() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	summary := fmt.Sprintf("%d succeeded, %d failed", r.Succeeded, r.Failed)
+	for _, stage := range []Stage{StageRead, StageDecode, StageReference, StageID, StageStats, StageMongo} {
+		if r.failedByStage[stage] > 0 {
+			summary += fmt.Sprintf(", %d at %s", r.failedByStage[stage], stage)
+		}
+	}
+	if len(r.Warnings) > 0 {
+		summary += fmt.Sprintf(" (%d warnings)", len(r.Warnings))
+	}
+	return summary
+}
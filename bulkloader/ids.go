@@ -0,0 +1,67 @@
+package bulkloader
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// IDStrategy is how new IDs are assigned to the resources being uploaded.
+type IDStrategy string
+
+const (
+	// ObjectIDs gives each resource a new, random BSON ObjectId. Loading the same bundle
+	// twice creates two copies of every resource.
+	ObjectIDs IDStrategy = "objectid"
+	// DeterministicIDs derives each resource's ID from the identity of its bundle and its
+	// fullUrl, so loading the same bundle twice gives its resources the same IDs. Resources
+	// are written with upserts, so re-running a load converges to the same database.
+	DeterministicIDs IDStrategy = "deterministic"
+	// PreservedIDs keeps each resource's source ID if it has a valid one, and gives it a
+	// new ObjectId otherwise. Uploading a resource whose ID is already in Mongo fails.
+	PreservedIDs IDStrategy = "preserve"
+)
+
+// validID matches a valid FHIR resource id.
+var validID = regexp.MustCompile(`^[A-Za-z0-9\-\.]{1,64}$`)
+
+// ParseIDStrategy returns the IDStrategy named s.
+func ParseIDStrategy(s string) (IDStrategy, error) {
+	switch strategy := IDStrategy(s); strategy {
+	case ObjectIDs, DeterministicIDs, PreservedIDs:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("unknown ID strategy '%s'", s)
+}
+
+// ValidID returns true if id is a valid FHIR resource id, and so can be preserved.
+func ValidID(id string) bool {
+	return validID.MatchString(id)
+}
+
+// DeterministicID returns an ID derived from the given parts, in the same 24 character hex
+// format as a BSON ObjectId.
+func DeterministicID(parts ...string) string {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:12])
+}
+
+// BundleIdentity returns a string identifying a bundle for DeterministicID: the bundle's
+// id or identifier if it has one, or else a hash of the bundle's JSON.
+func BundleIdentity(bundle *models.Bundle, data []byte) string {
+	if bundle.Id != "" {
+		return "Bundle/" + bundle.Id
+	}
+	if bundle.Identifier != nil && bundle.Identifier.Value != "" {
+		return "Bundle?identifier=" + bundle.Identifier.System + "|" + bundle.Identifier.Value
+	}
+	sum := sha1.Sum(data)
+	return "sha1:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,211 @@
+package bulkloader
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// indexProgressInterval is how often the progress of an index build is logged.
+const indexProgressInterval = 15 * time.Second
+
+// IndexSpec is an index on a Mongo collection.
+type IndexSpec struct {
+	Collection string
+	Key        []string // mgo index key fields, e.g. "subject.referenceid" or "-date"
+}
+
+// Name returns the name Mongo gives the index by default, e.g. "subject.referenceid_1".
+func (s IndexSpec) Name() string {
+	var parts []string
+	for _, field := range s.Key {
+		if strings.HasPrefix(field, "-") {
+			parts = append(parts, field[1:]+"_-1")
+		} else {
+			parts = append(parts, field+"_1")
+		}
+	}
+	return strings.Join(parts, "_")
+}
+
+func (s IndexSpec) String() string {
+	return s.Collection + "." + s.Name()
+}
+
+// ReadIndexConfig reads the indexes in a config file. Each line of the file is
+// "<collection>.<field>_<direction>", where direction is 1 (ascending) or -1 (descending),
+// or "<collection>.(<field>_<direction>, ...)" for a compound index. Blank lines and lines
+// starting with # are ignored.
+func ReadIndexConfig(path string) ([]IndexSpec, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var specs []IndexSpec
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		spec, err := parseIndexSpec(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, lineNum, err)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, scanner.Err()
+}
+
+// parseIndexSpec parses a line of an index config file.
+func parseIndexSpec(line string) (IndexSpec, error) {
+	dot := strings.Index(line, ".")
+	if dot <= 0 {
+		return IndexSpec{}, fmt.Errorf("invalid index '%s', expected <collection>.<field>_<direction>", line)
+	}
+	spec := IndexSpec{Collection: line[:dot]}
+
+	fields := line[dot+1:]
+	if strings.HasPrefix(fields, "(") && strings.HasSuffix(fields, ")") {
+		fields = fields[1 : len(fields)-1]
+	}
+
+	for _, field := range strings.Split(fields, ",") {
+		field = strings.TrimSpace(field)
+		switch i := strings.LastIndex(field, "_"); {
+		case i <= 0:
+			return IndexSpec{}, fmt.Errorf("invalid index field '%s', expected <field>_<direction>", field)
+		case field[i+1:] == "1":
+			spec.Key = append(spec.Key, field[:i])
+		case field[i+1:] == "-1":
+			spec.Key = append(spec.Key, "-"+field[:i])
+		default:
+			return IndexSpec{}, fmt.Errorf("invalid direction in index field '%s', expected 1 or -1", field)
+		}
+	}
+	return spec, nil
+}
+
+// DropIndexes drops the configured indexes, so that a bulk load doesn't have to update
+// them as it goes. Indexes that don't exist are skipped.
+func DropIndexes(mongoSession *mgo.Session, dbName string, specs []IndexSpec, retry RetryPolicy) error {
+	session := mongoSession.Copy()
+	defer session.Close()
+
+	for _, spec := range specs {
+		// the index is looked up again on each attempt, in case an earlier one dropped it
+		err := retry.DoMongo(session, "Dropping index "+spec.String(), func(attempt int) error {
+			existing, err := indexNames(session, dbName, spec.Collection)
+			if err != nil || !existing[spec.Name()] {
+				return err
+			}
+
+			log.Println("Dropping index", spec)
+			return session.DB(dbName).C(spec.Collection).DropIndexName(spec.Name())
+		})
+		if err != nil {
+			return fmt.Errorf("failed to drop index %s: %s", spec, err)
+		}
+	}
+	return nil
+}
+
+// CreateIndexes builds the configured indexes on the collections that exist, in the
+// background so that the database can still be used while they're built. The progress of
+// each build is logged as it goes.
+func CreateIndexes(mongoSession *mgo.Session, dbName string, specs []IndexSpec, retry RetryPolicy) error {
+	session := mongoSession.Copy()
+	defer session.Close()
+
+	names, err := session.DB(dbName).CollectionNames()
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool)
+	for _, name := range names {
+		exists[name] = true
+	}
+
+	for i, spec := range specs {
+		if !exists[spec.Collection] {
+			log.Printf("Skipping index %s, the collection doesn't exist\n", spec)
+			continue
+		}
+
+		log.Printf("Building index %d of %d: %s\n", i+1, len(specs), spec)
+		start := time.Now()
+
+		done := make(chan struct{})
+		go logIndexProgress(session, dbName, spec, done)
+
+		c := session.DB(dbName).C(spec.Collection)
+		err = retry.DoMongo(session, "Building index "+spec.String(), func(attempt int) error {
+			return c.EnsureIndex(mgo.Index{Key: spec.Key, Background: true})
+		})
+		close(done)
+		if err != nil {
+			return fmt.Errorf("failed to build index %s: %s", spec, err)
+		}
+		log.Printf("Built index %s in %s\n", spec, time.Since(start))
+	}
+	return nil
+}
+
+// logIndexProgress logs the progress Mongo reports for an index build until done is
+// closed.
+func logIndexProgress(mongoSession *mgo.Session, dbName string, spec IndexSpec, done <-chan struct{}) {
+	// the build blocks the session it runs on, so check progress on a separate one
+	session := mongoSession.Copy()
+	defer session.Close()
+
+	ticker := time.NewTicker(indexProgressInterval)
+	defer ticker.Stop()
+
+	ns := dbName + "." + spec.Collection
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			var result struct {
+				InProg []struct {
+					NS  string `bson:"ns"`
+					Msg string `bson:"msg"`
+				} `bson:"inprog"`
+			}
+			if err := session.DB("admin").Run(bson.M{"currentOp": 1}, &result); err != nil {
+				continue
+			}
+			for _, op := range result.InProg {
+				if op.NS == ns && strings.Contains(op.Msg, "Index Build") {
+					log.Printf("Building index %s: %s\n", spec, op.Msg)
+				}
+			}
+		}
+	}
+}
+
+// indexNames returns the names of the indexes on a collection.
+func indexNames(session *mgo.Session, dbName, collection string) (map[string]bool, error) {
+	names := make(map[string]bool)
+	indexes, err := session.DB(dbName).C(collection).Indexes()
+	if err != nil {
+		if strings.Contains(err.Error(), "ns does not exist") || strings.Contains(err.Error(), "ns not found") {
+			// no collection, so no indexes
+			return names, nil
+		}
+		return nil, err
+	}
+	for _, index := range indexes {
+		names[index.Name] = true
+	}
+	return names, nil
+}
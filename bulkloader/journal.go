@@ -0,0 +1,145 @@
+package bulkloader
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// journalAsOfPrefix starts the journal line recording the as-of date of the load, so that a
+// resumed load calculates ages at the same date.
+const journalAsOfPrefix = "# as-of "
+
+// journalRunPrefix starts the journal line recording the run ID of the load, so that a
+// resumed load is recorded, and can be rolled back, as the same run.
+const journalRunPrefix = "# run "
+
+// Journal is a checkpoint journal of the bundles that have been uploaded to Mongo, one
+// bundle path per line. It lets an interrupted load be resumed without uploading any
+// bundle twice. A Journal is safe for use by multiple workers at once.
+type Journal struct {
+	mu    sync.Mutex
+	file  *os.File
+	done  map[string]bool
+	asOf  string
+	runID string
+}
+
+// OpenJournal opens the journal at path. If resume is true the bundles already recorded
+// in the journal are read so they can be skipped, and new bundles are appended to it.
+// Otherwise any existing journal is discarded.
+func OpenJournal(path string, resume bool) (*Journal, error) {
+	j := &Journal{done: make(map[string]bool)}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resume {
+		flags = os.O_CREATE | os.O_RDWR | os.O_APPEND
+	}
+
+	var err error
+	j.file, err = os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if resume {
+		scanner := bufio.NewScanner(j.file)
+		scanner.Buffer(make([]byte, 4096), 1024*1024)
+		for scanner.Scan() {
+			switch line := scanner.Text(); {
+			case strings.HasPrefix(line, journalAsOfPrefix):
+				j.asOf = strings.TrimPrefix(line, journalAsOfPrefix)
+			case strings.HasPrefix(line, journalRunPrefix):
+				j.runID = strings.TrimPrefix(line, journalRunPrefix)
+			default:
+				j.done[line] = true
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			j.file.Close()
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// Len returns the number of bundles recorded in the journal.
+func (j *Journal) Len() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.done)
+}
+
+// AsOf returns the as-of date recorded in the journal by the load being resumed, in the
+// AsOfLayout, or "" if there isn't one.
+func (j *Journal) AsOf() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.asOf
+}
+
+// RecordAsOf records the as-of date of the load, in the AsOfLayout.
+func (j *Journal) RecordAsOf(asOf string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := fmt.Fprintln(j.file, journalAsOfPrefix+asOf); err != nil {
+		return err
+	}
+	j.asOf = asOf
+	return nil
+}
+
+// RunID returns the run ID recorded in the journal by the load being resumed, or "" if
+// there isn't one.
+func (j *Journal) RunID() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.runID
+}
+
+// RecordRunID records the run ID of the load.
+func (j *Journal) RecordRunID(runID string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := fmt.Fprintln(j.file, journalRunPrefix+runID); err != nil {
+		return err
+	}
+	j.runID = runID
+	return nil
+}
+
+// Done returns true if the bundle at path has already been uploaded.
+func (j *Journal) Done(path string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.done[path]
+}
+
+// Record records that the bundle at path has been uploaded. It should only be called
+// once UploadResources has returned for the bundle.
+func (j *Journal) Record(path string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := fmt.Fprintln(j.file, path); err != nil {
+		return err
+	}
+	j.done[path] = true
+	return nil
+}
+
+// Close flushes the journal to disk and closes it.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.file.Sync(); err != nil {
+		j.file.Close()
+		return err
+	}
+	return j.file.Close()
+}
@@ -0,0 +1,55 @@
+package bulkloader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bulkload.journal")
+
+	j, err := OpenJournal(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []func() error{
+		func() error { return j.RecordAsOf("2017-06-01") },
+		func() error { return j.RecordRunID("run1") },
+		func() error { return j.Record("a.json") },
+		func() error { return j.Record("b.json") },
+	} {
+		if err = record(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a resumed load picks up the as-of date, run ID and bundles of the load it resumes
+	j, err = OpenJournal(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.AsOf() != "2017-06-01" || j.RunID() != "run1" || j.Len() != 2 || !j.Done("a.json") || !j.Done("b.json") || j.Done("c.json") {
+		t.Errorf("resumed journal has as-of %q, run ID %q and %d bundles, want 2017-06-01, run1 and a.json, b.json", j.AsOf(), j.RunID(), j.Len())
+	}
+	j.Close()
+
+	// a new load starts the journal over
+	j, err = OpenJournal(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if j.AsOf() != "" || j.RunID() != "" || j.Len() != 0 {
+		t.Errorf("new journal has as-of %q, run ID %q and %d bundles, want none", j.AsOf(), j.RunID(), j.Len())
+	}
+}
@@ -0,0 +1,147 @@
+package bulkloader
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// manifestCollection is the Mongo collection holding a manifest document for each load.
+const manifestCollection = "loadmanifest"
+
+// Manifest records the Mongo collections written to by a load, so that a later reset can
+// drop exactly the collections that loads created. Each collection is recorded in the
+// load's manifest document the first time it's written to, before the write, so the
+// manifest is complete even if the load is interrupted. A Manifest is safe for use by
+// multiple workers at once.
+type Manifest struct {
+	mu          sync.Mutex
+	session     *mgo.Session
+	dbName      string
+	retry       RetryPolicy
+	runID       string
+	started     time.Time
+	collections map[string]bool
+}
+
+// NewManifest returns the Manifest of a new load, with a new run ID.
+func NewManifest(mongoSession *mgo.Session, dbName string, retry RetryPolicy) *Manifest {
+	return &Manifest{
+		session:     mongoSession,
+		dbName:      dbName,
+		retry:       retry,
+		runID:       bson.NewObjectId().Hex(),
+		started:     time.Now(),
+		collections: make(map[string]bool),
+	}
+}
+
+// ResumeManifest returns the Manifest of the load with the given run ID, which is being
+// resumed, with the collections it has already written to.
+func ResumeManifest(mongoSession *mgo.Session, dbName, runID string, retry RetryPolicy) (*Manifest, error) {
+	m := NewManifest(mongoSession, dbName, retry)
+	m.runID = runID
+
+	session := mongoSession.Copy()
+	defer session.Close()
+
+	var doc struct {
+		Started     time.Time `bson:"started"`
+		Collections []string  `bson:"collections"`
+	}
+	err := retry.DoMongo(session, "Reading "+manifestCollection, func(attempt int) error {
+		return session.DB(dbName).C(manifestCollection).FindId(runID).One(&doc)
+	})
+	switch {
+	case err == mgo.ErrNotFound:
+		// the load was interrupted before it wrote anything
+		return m, nil
+	case err != nil:
+		return nil, err
+	}
+
+	m.started = doc.Started
+	for _, name := range doc.Collections {
+		m.collections[name] = true
+	}
+	return m, nil
+}
+
+// RunID returns the ID of the load.
+func (m *Manifest) RunID() string {
+	return m.runID
+}
+
+// Record records that the load is about to write to a collection.
+func (m *Manifest) Record(collection string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.collections[collection] {
+		return nil
+	}
+
+	session := m.session.Copy()
+	defer session.Close()
+
+	c := session.DB(m.dbName).C(manifestCollection)
+	err := m.retry.DoMongo(session, "Updating "+manifestCollection, func(attempt int) error {
+		_, err := c.UpsertId(m.runID, bson.M{
+			"$setOnInsert": bson.M{"started": m.started},
+			"$addToSet":    bson.M{"collections": collection},
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	m.collections[collection] = true
+	return nil
+}
+
+// Collections returns the collections written to by the load so far.
+func (m *Manifest) Collections() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var names []string
+	for name := range m.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// recordCollection records a collection in the Uploader's Manifest, if it has one.
+func (u *Uploader) recordCollection(collection string) error {
+	if u.Manifest == nil {
+		return nil
+	}
+	return u.Manifest.Record(collection)
+}
+
+// manifestCollections returns the collections recorded in the manifests of previous loads.
+func manifestCollections(session *mgo.Session, dbName string) ([]string, error) {
+	var names []string
+	err := session.DB(dbName).C(manifestCollection).Find(nil).Distinct("collections", &names)
+	return names, err
+}
+
+// allResourceCollections returns the collections of every FHIR resource type, and rawstat.
+// The resource types are those the GoFHIR server has search parameters for that are also in
+// the models package.
+func allResourceCollections() []string {
+	names := []string{"rawstat"}
+	for resourceType := range search.SearchParameterDictionary {
+		if models.NewStructForResourceName(resourceType) != nil {
+			names = append(names, models.PluralizeLowerResourceName(resourceType))
+		}
+	}
+	sort.Strings(names[1:])
+	return names
+}
@@ -0,0 +1,244 @@
+package bulkloader
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/lib/pq"
+)
+
+// Migration is a versioned change to the Postgres schema the statistics are written to.
+type Migration struct {
+	Version     int
+	Description string
+	// SQL returns the statements that apply the migration to a schema.
+	SQL func(s Schema) string
+}
+
+// migrations are applied in order by Migrate. Never change a migration that has been
+// released; add a new one instead. The migrations skip the tables that already exist, so
+// that a schema created by hand (e.g. from the pgstats repo) can be adopted by migrating it.
+var migrations = []Migration{
+	{1, "Create the dimension and fact tables", func(s Schema) string {
+		return fmt.Sprintf(`
+create table if not exists %[1]s (
+	cs_fips varchar(10) primary key,
+	cs_name varchar(100) not null,
+	ct_fips varchar(10) not null,
+	ct_name varchar(100),
+	sq_mi   numeric
+);
+
+create table if not exists %[2]s (
+	disease_id   integer primary key,
+	disease_name varchar(100) not null
+);
+
+create table if not exists %[3]s (
+	condition_id   integer primary key,
+	condition_name varchar(255) not null,
+	code_system    varchar(100) not null,
+	code           varchar(50) not null,
+	disease_id     integer references %[2]s (disease_id)
+);
+
+create table if not exists %[4]s (
+	cs_fips    varchar(10) not null,
+	age_id     integer not null,
+	pop        integer not null,
+	pop_male   integer not null,
+	pop_female integer not null
+);
+
+create table if not exists %[5]s (
+	cs_fips    varchar(10) not null,
+	disease_id integer not null,
+	age_id     integer not null,
+	pop        integer not null,
+	pop_male   integer not null,
+	pop_female integer not null
+);
+
+create table if not exists %[6]s (
+	cs_fips      varchar(10) not null,
+	condition_id integer not null,
+	age_id       integer not null,
+	pop          integer not null,
+	pop_male     integer not null,
+	pop_female   integer not null
+);`,
+			s.Table(s.CousubDim), s.Table(s.DiseaseDim), s.Table(s.ConditionDim),
+			s.Table(s.PopFacts), s.Table(s.DiseaseFacts), s.Table(s.ConditionFacts))
+	}},
+	{2, "Create the age dimension table", func(s Schema) string {
+		return fmt.Sprintf(`
+create table if not exists %[1]s (
+	age_id   integer primary key,
+	age_name varchar(50) not null,
+	min_age  integer not null,
+	max_age  integer,
+	check (min_age >= 0 and (max_age is null or max_age >= min_age))
+);
+
+insert into %[1]s (age_id, age_name, min_age, max_age)
+select * from (values
+	(1, '0-17', 0, 17),
+	(2, '18-34', 18, 34),
+	(3, '35-49', 35, 49),
+	(4, '50-64', 50, 64),
+	(5, '65+', 65, null)
+) as bands (age_id, age_name, min_age, max_age)
+where not exists (select 1 from %[1]s);`, s.Table(s.AgeDim))
+	}},
+	{3, "Create the mortality fact table", func(s Schema) string {
+		return fmt.Sprintf(`
+create table if not exists %[1]s (
+	cs_fips    varchar(10) not null,
+	age_id     integer not null,
+	death_year integer,
+	disease_id integer,
+	pop        integer not null,
+	pop_male   integer not null,
+	pop_female integer not null
+);`, s.Table(s.MortalityFacts))
+	}},
+	{4, "Create the active disease and condition fact tables", func(s Schema) string {
+		return fmt.Sprintf(`
+create table if not exists %[1]s (
+	cs_fips    varchar(10) not null,
+	disease_id integer not null,
+	age_id     integer not null,
+	pop        integer not null,
+	pop_male   integer not null,
+	pop_female integer not null
+);
+
+create table if not exists %[2]s (
+	cs_fips      varchar(10) not null,
+	condition_id integer not null,
+	age_id       integer not null,
+	pop          integer not null,
+	pop_male     integer not null,
+	pop_female   integer not null
+);`, s.Table(s.ActiveDiseaseFacts), s.Table(s.ActiveConditionFacts))
+	}},
+	{5, "Create the load run audit tables", func(s Schema) string {
+		return fmt.Sprintf(`
+create table if not exists %[1]s (
+	run_id            text primary key,
+	started_at        timestamptz not null,
+	finished_at       timestamptz,
+	status            text not null,
+	options           jsonb not null,
+	source            text,
+	journal_path      text,
+	report_path       text,
+	bundles_succeeded integer not null default 0,
+	bundles_failed    integer not null default 0,
+	resources         bigint not null default 0,
+	warnings          integer not null default 0,
+	error             text
+);
+
+create table if not exists %[2]s (
+	run_id        text not null references %[1]s (run_id) on delete cascade,
+	resource_type text not null,
+	resources     bigint not null,
+	primary key (run_id, resource_type)
+);`, s.Table(s.LoadRuns), s.Table(s.LoadRunCounts))
+	}},
+}
+
+// LatestSchemaVersion is the version of the schema the loader expects.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion returns the version of a schema, i.e. the last migration applied to it. A
+// schema without a schema_migrations table, e.g. one created by hand, has version 0.
+func SchemaVersion(db *sql.DB, schema Schema) (int, error) {
+	var exists bool
+	err := db.QueryRow(`select to_regclass($1) is not null`, schema.Table("schema_migrations")).Scan(&exists)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	err = db.QueryRow(`select max(version) from ` + schema.Table("schema_migrations")).Scan(&version)
+	return int(version.Int64), err
+}
+
+// CheckSchemaVersion returns an error if a schema isn't at the version the loader expects.
+// A schema that isn't managed by Migrate, e.g. one created by hand, is refused too, unless
+// unversioned is true, in which case it's assumed to be correct.
+func CheckSchemaVersion(db *sql.DB, schema Schema, unversioned bool) error {
+	version, err := SchemaVersion(db, schema)
+	switch {
+	case err != nil:
+		return err
+	case version == 0 && unversioned:
+		log.Printf("[WARNING] Schema %s has no migration history, assuming it's up to date\n", schema.Name)
+	case version == 0:
+		return fmt.Errorf("schema %s has no migration history. Run init-db to adopt it, or use -unversioned-schema to load into it as it is", schema.Name)
+	case version < LatestSchemaVersion():
+		return fmt.Errorf("schema %s is at version %d, but the loader needs version %d. Run init-db to migrate it", schema.Name, version, LatestSchemaVersion())
+	case version > LatestSchemaVersion():
+		return fmt.Errorf("schema %s is at version %d, which is newer than this loader (version %d)", schema.Name, version, LatestSchemaVersion())
+	}
+	return nil
+}
+
+// Migrate creates the schema if it doesn't exist and applies the migrations that haven't
+// been applied to it yet, each in its own transaction. It returns the migrations applied.
+func Migrate(db *sql.DB, schema Schema) ([]Migration, error) {
+	_, err := db.Exec(fmt.Sprintf(`
+create schema if not exists %s;
+
+create table if not exists %s (
+	version     integer primary key,
+	description text not null,
+	applied_at  timestamptz not null default now()
+);`, pq.QuoteIdentifier(schema.Name), schema.Table("schema_migrations")))
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := SchemaVersion(db, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		log.Printf("Applying migration %d to %s: %s\n", m.Version, schema.Name, m.Description)
+		if err = applyMigration(db, schema, m); err != nil {
+			return applied, fmt.Errorf("migration %d failed: %s", m.Version, err)
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// applyMigration applies a migration and records it in the schema_migrations table, in a
+// single transaction.
+func applyMigration(db *sql.DB, schema Schema, m Migration) error {
+	txn, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// a no-op once the transaction is committed
+	defer txn.Rollback()
+
+	if _, err = txn.Exec(m.SQL(schema)); err != nil {
+		return err
+	}
+	_, err = txn.Exec(`insert into `+schema.Table("schema_migrations")+` (version, description) values ($1, $2)`, m.Version, m.Description)
+	if err != nil {
+		return err
+	}
+	return txn.Commit()
+}
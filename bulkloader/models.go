@@ -1,5 +1,7 @@
 package bulkloader
 
+import "time"
+
 // RawStats is a document in the fhir.rawstats collection representing the
 // raw, aggregated statistics for a subdivision generated after a bulk upload.
 type RawStats struct {
@@ -12,6 +14,11 @@ type RawStats struct {
 	Conditions       []ConditionCode `bson:"conditions,omitempty" json:"conditions,omitempty"`
 	UniqueConditions []int           `bson:"uniqueconditions,omitempty" json:"uniqueconditions,omitempty"`
 	UniqueDiseases   []int           `bson:"uniquediseases,omitempty" json:"uniquediseases,omitempty"`
+	ActiveConditions []int           `bson:"activeconditions,omitempty" json:"activeconditions,omitempty"`
+	ActiveDiseases   []int           `bson:"activediseases,omitempty" json:"activediseases,omitempty"`
+	DeathYear        int             `bson:"deathyear,omitempty" json:"deathyear,omitempty"`
+	CauseOfDeath     *ConditionCode  `bson:"causeofdeath,omitempty" json:"causeofdeath,omitempty"`
+	RunID            string          `bson:"runid,omitempty" json:"runid,omitempty"`
 }
 
 // ConditionCode is a unique condition represented by a code system (e.g. SNOMED_CT) and code,
@@ -21,6 +28,12 @@ type ConditionCode struct {
 	Code        string `bson:"code,omitempty" json:"code,omitempty"`
 	ConditionID int    `bson:"conditionid" json:"conditionid"`
 	DiseaseID   int    `bson:"diseaseid" json:"diseaseid"`
+	// the status and timing of the Condition the code is from
+	ClinicalStatus     string     `bson:"clinicalstatus,omitempty" json:"clinicalstatus,omitempty"`
+	VerificationStatus string     `bson:"verificationstatus,omitempty" json:"verificationstatus,omitempty"`
+	Onset              *time.Time `bson:"onset,omitempty" json:"onset,omitempty"`
+	Abatement          *time.Time `bson:"abatement,omitempty" json:"abatement,omitempty"`
+	Abated             bool       `bson:"abated,omitempty" json:"abated,omitempty"`
 }
 
 // Cousub represents a county subdivision.
@@ -0,0 +1,304 @@
+package bulkloader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// IDRegistry maps the source IDs of resources in a set of FHIR Bulk Data NDJSON files to
+// new server-assigned IDs. Unlike a bundle, the resources referenced by an NDJSON resource
+// usually live in a different file (e.g. a Condition's subject is in Patient.ndjson), so the
+// registry is shared by all workers and populated by ScanNDJSON before any resources are
+// uploaded.
+type IDRegistry struct {
+	mu       sync.RWMutex
+	refs     map[string]models.Reference
+	strategy IDStrategy
+}
+
+// NewIDRegistry returns an empty IDRegistry that assigns IDs using the given strategy.
+// With DeterministicIDs a resource's ID is derived from its type and source ID, and with
+// PreservedIDs a valid source ID is kept as it is.
+func NewIDRegistry(strategy IDStrategy) *IDRegistry {
+	return &IDRegistry{refs: make(map[string]models.Reference), strategy: strategy}
+}
+
+// Register assigns a new server ID to the resource with the given type and source ID and
+// returns it. Registering the same resource again returns the ID assigned the first time.
+// The resource can then be referenced as "Type/id" or "urn:uuid:id".
+func (r *IDRegistry) Register(resourceType, id string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := resourceType + "/" + id
+	if ref, ok := r.refs[key]; ok {
+		return ref.ReferencedID
+	}
+
+	var newID string
+	switch {
+	case r.strategy == DeterministicIDs:
+		newID = DeterministicID(resourceType, id)
+	case r.strategy == PreservedIDs && ValidID(id):
+		newID = id
+	default:
+		newID = bson.NewObjectId().Hex()
+	}
+	ref := models.Reference{
+		Reference:    resourceType + "/" + newID,
+		Type:         resourceType,
+		ReferencedID: newID,
+		External:     new(bool),
+	}
+	r.refs[key] = ref
+	if _, ok := r.refs["urn:uuid:"+id]; !ok {
+		r.refs["urn:uuid:"+id] = ref
+	}
+	return newID
+}
+
+// RegisterAssigned registers a resource that has already been given its server ID, e.g.
+// one quarantined by an earlier load, so that it keeps the ID rather than being assigned a
+// new one, and the references to it from resources that did load still resolve.
+func (r *IDRegistry) RegisterAssigned(resourceType, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := resourceType + "/" + id
+	if _, ok := r.refs[key]; ok {
+		return
+	}
+	r.refs[key] = models.Reference{
+		Reference:    key,
+		Type:         resourceType,
+		ReferencedID: id,
+		External:     new(bool),
+	}
+}
+
+// Lookup returns the server reference for a source reference, e.g. "Patient/123".
+func (r *IDRegistry) Lookup(reference string) (models.Reference, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ref, ok := r.refs[reference]
+	return ref, ok
+}
+
+// UpdateNDJSONReferences rewrites all of the references in resource to point to the
+// server IDs in the registry. References to resources that are not in the registry are
+// left as they are.
+func UpdateNDJSONReferences(resource interface{}, registry *IDRegistry) {
+	for _, ref := range findRefsInValue(reflect.ValueOf(resource)) {
+		newRef, found := registry.Lookup(ref.Reference)
+		if found {
+			*ref = newRef
+		}
+	}
+}
+
+// ScanNDJSON registers the type and ID of every resource in an NDJSON stream, without
+// fully decoding the resources. If assigned is true the resources have already been given
+// their server IDs (i.e. they were quarantined by an earlier load), and keep them.
+func ScanNDJSON(r io.Reader, registry *IDRegistry, assigned bool) error {
+	return ReadNDJSONLines(r, func(lineNum int, line []byte) error {
+		var header struct {
+			ResourceType string `json:"resourceType"`
+			ID           string `json:"id"`
+		}
+		if err := json.Unmarshal(line, &header); err != nil {
+			return fmt.Errorf("line %d: %s", lineNum, err)
+		}
+		switch {
+		case header.ResourceType == "" || header.ID == "":
+		case assigned:
+			registry.RegisterAssigned(header.ResourceType, header.ID)
+		default:
+			registry.Register(header.ResourceType, header.ID)
+		}
+		return nil
+	})
+}
+
+// AssignNDJSONID returns an NDJSON line that couldn't be decoded into a resource with its
+// id replaced by the server ID the registry assigned to it, so that when it's quarantined
+// and retried it keeps that ID. The line is returned as it is if it isn't a JSON object with
+// a registered resourceType and id.
+func AssignNDJSONID(line []byte, registry *IDRegistry) []byte {
+	var resourceMap map[string]interface{}
+	if err := json.Unmarshal(line, &resourceMap); err != nil {
+		return line
+	}
+	resourceType, _ := resourceMap["resourceType"].(string)
+	id, _ := resourceMap["id"].(string)
+	ref, ok := registry.Lookup(resourceType + "/" + id)
+	if !ok {
+		return line
+	}
+	resourceMap["id"] = ref.ReferencedID
+	assigned, err := json.Marshal(resourceMap)
+	if err != nil {
+		return line
+	}
+	return assigned
+}
+
+// ReadNDJSONLines calls fn with the line number and contents of each non-blank line in an
+// NDJSON stream. Lines are not length limited, since a single resource can be very large.
+func ReadNDJSONLines(r io.Reader, fn func(lineNum int, line []byte) error) error {
+	reader := bufio.NewReader(r)
+	lineNum := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		lineNum++
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			if ferr := fn(lineNum, line); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// DecodeResource decodes a single line of an NDJSON file into a FHIR resource.
+func DecodeResource(line []byte) (interface{}, error) {
+	var resourceMap map[string]interface{}
+	if err := json.Unmarshal(line, &resourceMap); err != nil {
+		return nil, err
+	}
+	resource := models.MapToResource(resourceMap, true)
+	if resource == nil {
+		return nil, fmt.Errorf("unknown resource type %v", resourceMap["resourceType"])
+	}
+	return resource, nil
+}
+
+// NDJSONBatch is a batch of resources read from NDJSON files, to be uploaded together.
+// Since a patient's conditions are not uploaded in the same batch as the patient, the
+// patient's rawstat document is built up incrementally: each Patient sets the demographics
+// and each Condition (or cause of death Observation) is added to the document of the
+// patient it references.
+type NDJSONBatch struct {
+	uploader  *Uploader
+	resources []interface{}
+	updates   []interface{} // selector/update pairs for the rawstat collection
+}
+
+// NewNDJSONBatch returns an empty batch to be uploaded by u.
+func (u *Uploader) NewNDJSONBatch() *NDJSONBatch {
+	return &NDJSONBatch{uploader: u}
+}
+
+// Len returns the number of resources in the batch.
+func (b *NDJSONBatch) Len() int {
+	return len(b.resources)
+}
+
+// Add adds a resource to the batch, along with the update to its patient's rawstat
+// document. The resource's ID and references must already have been updated using an
+// IDRegistry. If the statistics can't be collected the resource isn't added and a
+// *BundleError is returned. Data quality problems that don't stop the resource being added,
+// e.g. a condition with no code, are returned as a warning.
+func (b *NDJSONBatch) Add(resource interface{}) (warning, err error) {
+	switch r := resource.(type) {
+	case *models.Patient:
+		var basestat RawStats
+		if warning, err = setPatientStats(&basestat, r, b.uploader.Cousubs, b.uploader.AgeBands, b.uploader.AsOf); err != nil {
+			return nil, stageError(StageStats, err)
+		}
+		if warning != nil {
+			break
+		}
+		b.updates = append(b.updates, bson.M{"_id": basestat.ID}, bson.M{"$set": bson.M{
+			"location":        basestat.Location,
+			"gender":          basestat.Gender,
+			"agerange":        basestat.AgeRange,
+			"age":             basestat.Age,
+			"deceasedboolean": basestat.DeceasedBoolean,
+			"deathyear":       basestat.DeathYear,
+			"runid":           b.uploader.runID(),
+		}})
+	case *models.Condition:
+		if r.Subject == nil || r.Subject.Type != "Patient" || r.Subject.ReferencedID == "" {
+			// the patient isn't part of this load, so there's no rawstat to add it to
+			break
+		}
+		condcodes, err := getConditionCodes(r, b.uploader.Diseases)
+		if err != nil {
+			warning = err
+			break
+		}
+		b.updates = append(b.updates, bson.M{"_id": r.Subject.ReferencedID}, conditionUpdate(condcodes, b.uploader.AsOf))
+	case *models.Observation:
+		if r.Subject == nil || r.Subject.Type != "Patient" || r.Subject.ReferencedID == "" {
+			break
+		}
+		if cause, ok := getCauseOfDeath(r, b.uploader.Diseases); ok {
+			b.updates = append(b.updates, bson.M{"_id": r.Subject.ReferencedID}, bson.M{
+				"$set": bson.M{"causeofdeath": cause},
+			})
+		}
+	}
+
+	b.resources = append(b.resources, resource)
+	return warning, nil
+}
+
+// Upload uploads the resources in the batch to the Mongo database and updates the rawstat
+// documents of their patients. The returned error is a *BundleError.
+func (b *NDJSONBatch) Upload() error {
+
+	// create a copy of the master Mongo session for this upload
+	session := b.uploader.Session.Copy()
+	defer session.Close()
+
+	if err := b.uploader.checkCollisions(session, b.resources); err != nil {
+		return err
+	}
+
+	SetMeta(b.resources, time.Now())
+	TagRun(b.resources, b.uploader.runID())
+	if err := b.uploader.insertResources(session, b.resources); err != nil {
+		return stageError(StageMongo, err)
+	}
+
+	if len(b.updates) == 0 {
+		return nil
+	}
+	if err := b.uploader.recordCollection("rawstat"); err != nil {
+		return stageError(StageMongo, err)
+	}
+
+	// the updates are idempotent, so they can simply be run again. Concurrent upserts of
+	// the same patient's document can also race and fail with a duplicate key error, which
+	// succeeds when retried.
+	retry := b.uploader.Retry
+	retry.Retryable = func(err error) bool {
+		return mgo.IsDup(err) || IsRetryable(err)
+	}
+	err := retry.DoMongo(session, "Updating rawstat", func(attempt int) error {
+		x := session.DB(b.uploader.DBName).C("rawstat").Bulk()
+		x.Unordered()
+		x.Upsert(b.updates...)
+		_, err := x.Run()
+		return err
+	})
+	if err != nil {
+		return stageError(StageMongo, err)
+	}
+	return nil
+}
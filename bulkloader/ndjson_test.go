@@ -0,0 +1,158 @@
+package bulkloader
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIDRegistryRegister(t *testing.T) {
+	tests := []struct {
+		strategy IDStrategy
+		id       string
+		want     string // "" for a new ObjectId
+	}{
+		{ObjectIDs, "123", ""},
+		{DeterministicIDs, "123", DeterministicID("Patient", "123")},
+		{PreservedIDs, "123", "123"},
+		{PreservedIDs, "not/valid", ""},
+	}
+
+	for _, tt := range tests {
+		registry := NewIDRegistry(tt.strategy)
+		newID := registry.Register("Patient", tt.id)
+		switch {
+		case tt.want == "" && (!ValidID(newID) || len(newID) != 24 || newID == tt.id):
+			t.Errorf("%s: Register(%q) = %q, want a new ObjectId", tt.strategy, tt.id, newID)
+		case tt.want != "" && newID != tt.want:
+			t.Errorf("%s: Register(%q) = %q, want %q", tt.strategy, tt.id, newID, tt.want)
+		}
+
+		// registering the resource again gives it the same ID
+		if again := registry.Register("Patient", tt.id); again != newID {
+			t.Errorf("%s: registering %q again gave %q, want %q", tt.strategy, tt.id, again, newID)
+		}
+
+		for _, reference := range []string{"Patient/" + tt.id, "urn:uuid:" + tt.id} {
+			ref, ok := registry.Lookup(reference)
+			if !ok || ref.Reference != "Patient/"+newID || ref.ReferencedID != newID || ref.Type != "Patient" {
+				t.Errorf("%s: Lookup(%q) = %+v, %t, want a reference to Patient/%s", tt.strategy, reference, ref, ok, newID)
+			}
+		}
+		if _, ok := registry.Lookup("Condition/" + tt.id); ok {
+			t.Errorf("%s: Lookup(Condition/%s) found a resource that wasn't registered", tt.strategy, tt.id)
+		}
+	}
+}
+
+func TestIDRegistryURNFirstWins(t *testing.T) {
+	// resources of different types can share a source id, but a urn:uuid reference has no
+	// type, so it refers to the first one registered
+	registry := NewIDRegistry(DeterministicIDs)
+	patientID := registry.Register("Patient", "1")
+	registry.Register("Encounter", "1")
+
+	if ref, _ := registry.Lookup("urn:uuid:1"); ref.ReferencedID != patientID {
+		t.Errorf("Lookup(urn:uuid:1) = %+v, want Patient/%s", ref, patientID)
+	}
+}
+
+func TestReadNDJSONLines(t *testing.T) {
+	type line struct {
+		num  int
+		text string
+	}
+	tests := []struct {
+		name  string
+		input string
+		want  []line
+	}{
+		{"empty", "", nil},
+		{"one line without a newline", `{"a":1}`, []line{{1, `{"a":1}`}}},
+		{"blank lines skipped but counted", "{\"a\":1}\n\n  \n{\"b\":2}\n", []line{{1, `{"a":1}`}, {4, `{"b":2}`}}},
+		{"CRLF line endings", "{\"a\":1}\r\n{\"b\":2}\r\n", []line{{1, `{"a":1}`}, {2, `{"b":2}`}}},
+		{"long line", strings.Repeat("x", 200000), []line{{1, strings.Repeat("x", 200000)}}},
+	}
+
+	for _, tt := range tests {
+		var got []line
+		err := ReadNDJSONLines(strings.NewReader(tt.input), func(lineNum int, data []byte) error {
+			got = append(got, line{lineNum, string(data)})
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: got error %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadNDJSONLinesStops(t *testing.T) {
+	stop := errors.New("stop")
+	calls := 0
+	err := ReadNDJSONLines(strings.NewReader("1\n2\n3\n"), func(lineNum int, data []byte) error {
+		calls++
+		if lineNum == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || calls != 2 {
+		t.Errorf("got error %v after %d lines, want %v after 2", err, calls, stop)
+	}
+}
+
+func TestQuarantinedNDJSONKeepsIDs(t *testing.T) {
+	for _, strategy := range []IDStrategy{ObjectIDs, DeterministicIDs, PreservedIDs} {
+		// the first load assigns IDs to a patient and its condition, and the condition fails
+		first := NewIDRegistry(strategy)
+		source := "{\"resourceType\":\"Patient\",\"id\":\"p1\"}\n{\"resourceType\":\"Condition\",\"id\":\"c1\",\"subject\":{\"reference\":\"Patient/p1\"}}\n"
+		if err := ScanNDJSON(strings.NewReader(source), first, false); err != nil {
+			t.Fatalf("%s: %s", strategy, err)
+		}
+		patientID := first.Register("Patient", "p1")
+		conditionID := first.Register("Condition", "c1")
+
+		// it's quarantined with its new ID and reference, and retried from the quarantine
+		quarantined := `{"resourceType":"Condition","id":"` + conditionID + `","subject":{"reference":"Patient/` + patientID + `"}}`
+		retry := NewIDRegistry(strategy)
+		if err := ScanNDJSON(strings.NewReader(quarantined), retry, true); err != nil {
+			t.Fatalf("%s: %s", strategy, err)
+		}
+		if id := retry.Register("Condition", conditionID); id != conditionID {
+			t.Errorf("%s: retried condition was given ID %s, want %s", strategy, id, conditionID)
+		}
+		if ref, ok := retry.Lookup("Condition/" + conditionID); !ok || ref.ReferencedID != conditionID {
+			t.Errorf("%s: Lookup(Condition/%s) = %+v, %t", strategy, conditionID, ref, ok)
+		}
+		// the patient loaded the first time, so the reference to it is left as it is
+		if ref, ok := retry.Lookup("Patient/" + patientID); ok {
+			t.Errorf("%s: the reference to the loaded patient would be rewritten to %s", strategy, ref.Reference)
+		}
+	}
+}
+
+func TestAssignNDJSONID(t *testing.T) {
+	registry := NewIDRegistry(DeterministicIDs)
+	newID := registry.Register("Patient", "p1")
+
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`{"resourceType":"Patient","id":"p1","unknown":true}`, `{"id":"` + newID + `","resourceType":"Patient","unknown":true}`},
+		{`{"resourceType":"Patient","id":"p2"}`, `{"resourceType":"Patient","id":"p2"}`},
+		{`{"resourceType":"Patient"`, `{"resourceType":"Patient"`},
+		{`[1, 2]`, `[1, 2]`},
+	}
+
+	for _, tt := range tests {
+		if got := string(AssignNDJSONID([]byte(tt.line), registry)); got != tt.want {
+			t.Errorf("AssignNDJSONID(%s) = %s, want %s", tt.line, got, tt.want)
+		}
+	}
+}
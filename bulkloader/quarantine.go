@@ -0,0 +1,139 @@
+package bulkloader
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrorFileSuffix is the suffix of the sidecar file describing why a quarantined bundle
+// failed to load. The walker skips these files, so a quarantine directory can be loaded
+// like any other directory of bundles.
+const ErrorFileSuffix = ".error.json"
+
+// Quarantine is a directory that bundles which fail to load are copied to, each with a
+// sidecar .error.json file describing the failure. A later load pointed at the quarantine
+// directory retries just those bundles, and removes each one that loads successfully.
+type Quarantine struct {
+	dir string
+}
+
+// NewQuarantine returns a Quarantine that copies bundles to dir, creating it if necessary.
+func NewQuarantine(dir string) (*Quarantine, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(absDir, 0755); err != nil {
+		return nil, err
+	}
+	return &Quarantine{dir: absDir}, nil
+}
+
+// Add copies the data of a bundle that failed to load into the quarantine, along with a
+// sidecar describing berr. ext is the extension the copy needs for a later load to pick it
+// up, e.g. ".json".
+func (q *Quarantine) Add(berr *BundleError, data []byte, ext string) error {
+	name, retried := q.file(berr.Path)
+	if !retried && !strings.HasSuffix(name, ext) {
+		name += ext
+	}
+
+	err := q.writeSidecar(name, struct {
+		Path    string    `json:"path"`
+		Stage   Stage     `json:"stage"`
+		Message string    `json:"message"`
+		Time    time.Time `json:"time"`
+	}{berr.Path, berr.Stage, berr.Err.Error(), time.Now()})
+	if err != nil {
+		return err
+	}
+
+	// a bundle that failed again on retry is already in the quarantine
+	if retried {
+		return nil
+	}
+	return ioutil.WriteFile(name, data, 0644)
+}
+
+// AddNDJSON copies the lines of the NDJSON file at path that failed to load into the
+// quarantine, as a file with the same name, along with a sidecar describing all of their
+// failures. If the file is being retried from the quarantine, it's replaced with just the
+// lines that failed again.
+func (q *Quarantine) AddNDJSON(path string, failures []*BundleError, lines [][]byte) error {
+	name, _ := q.file(path)
+
+	type failure struct {
+		Path    string `json:"path"`
+		Stage   Stage  `json:"stage"`
+		Message string `json:"message"`
+	}
+	sidecar := struct {
+		Path     string    `json:"path"`
+		Failures []failure `json:"failures"`
+		Time     time.Time `json:"time"`
+	}{Path: path, Time: time.Now()}
+	for _, berr := range failures {
+		sidecar.Failures = append(sidecar.Failures, failure{berr.Path, berr.Stage, berr.Err.Error()})
+	}
+	if err := q.writeSidecar(name, sidecar); err != nil {
+		return err
+	}
+
+	var data []byte
+	for _, line := range lines {
+		data = append(append(data, line...), '\n')
+	}
+	return ioutil.WriteFile(name, data, 0644)
+}
+
+// writeSidecar writes the sidecar describing why the file name in the quarantine failed to
+// load, creating the file's directory if necessary.
+func (q *Quarantine) writeSidecar(name string, v interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	sidecar, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(strings.TrimSuffix(name, filepath.Ext(name))+ErrorFileSuffix, sidecar, 0644)
+}
+
+// Release removes a bundle that has now loaded successfully from the quarantine. Bundles
+// that aren't in the quarantine directory are left alone.
+func (q *Quarantine) Release(path string) error {
+	name, ok := q.file(path)
+	if !ok {
+		return nil
+	}
+	if err := os.Remove(strings.TrimSuffix(name, filepath.Ext(name)) + ErrorFileSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(name)
+}
+
+// Contains returns true if the bundle at path is in the quarantine, i.e. it's being retried.
+func (q *Quarantine) Contains(path string) bool {
+	_, retried := q.file(path)
+	return retried
+}
+
+// file returns the path in the quarantine of the bundle at path, and true if the bundle is
+// already in the quarantine (i.e. it's being retried). Bundles are copied to the quarantine
+// under their absolute path (e.g. /path/to/bundles/x.json is quarantined as
+// <dir>/path/to/bundles/x.json), so that they keep their names and bundles with the same
+// name in different directories don't collide.
+func (q *Quarantine) file(path string) (string, bool) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		absPath = filepath.Clean(path)
+	}
+	if strings.HasPrefix(absPath, q.dir+string(filepath.Separator)) {
+		return absPath, true
+	}
+	return filepath.Join(q.dir, strings.TrimPrefix(absPath, filepath.VolumeName(absPath))), false
+}
@@ -0,0 +1,227 @@
+package bulkloader
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// relativeRef matches a relative reference ("Patient/123" or "Patient/123/_history/2"),
+// or the end of an absolute one.
+var relativeRef = regexp.MustCompile(`(?:^|/)([A-Z][A-Za-z]+)/([A-Za-z0-9\-\.]{1,64})(?:/_history/[A-Za-z0-9\-\.]{1,64})?$`)
+
+// conditionalRef matches a conditional reference, e.g. "Patient?identifier=sys|val".
+var conditionalRef = regexp.MustCompile(`^([A-Z][A-Za-z]+)\?(.+)$`)
+
+// UnresolvedReference is a reference in a bundle that couldn't be resolved to a resource
+// in the bundle or in Mongo, and so was left as it is.
+type UnresolvedReference struct {
+	Source    string // the resource containing the reference, e.g. "Observation/<new id>"
+	Reference string
+	Reason    string
+}
+
+func (u UnresolvedReference) String() string {
+	return fmt.Sprintf("%s -> %s (%s)", u.Source, u.Reference, u.Reason)
+}
+
+// ReferenceResolver rewrites the references between the resources in a bundle to use the
+// resources' new IDs. A reference can be the fullUrl of an entry (including "urn:uuid:"
+// fullUrls), a relative reference like "Patient/123" to the source ID of an entry or a
+// resource already in Mongo, or a conditional reference like "Patient?identifier=sys|val",
+// which is resolved against the entries and then the resources already in Mongo.
+type ReferenceResolver struct {
+	uploader *Uploader
+	refs     map[string]*models.Reference // keyed by fullUrl and "Type/sourceID"
+	entries  []*models.BundleEntryComponent
+}
+
+// NewReferenceResolver returns a resolver for the references in a single bundle. Mongo is
+// searched using the Uploader's session.
+func (u *Uploader) NewReferenceResolver() *ReferenceResolver {
+	return &ReferenceResolver{uploader: u, refs: make(map[string]*models.Reference)}
+}
+
+// Add adds a bundle entry whose resource has been given its new ID. sourceID is the ID the
+// resource had in the bundle, if any.
+func (r *ReferenceResolver) Add(entry *models.BundleEntryComponent, sourceID string) {
+	resourceType := reflect.TypeOf(entry.Resource).Elem().Name()
+	ref := newReference(resourceType, GetID(entry.Resource))
+
+	if entry.FullUrl != "" {
+		r.refs[entry.FullUrl] = ref
+	}
+	if sourceID != "" {
+		r.refs[resourceType+"/"+sourceID] = ref
+	}
+	r.entries = append(r.entries, entry)
+}
+
+// ResolveAll rewrites the references in all of the entries added to the resolver, and
+// returns the references it couldn't resolve. An error is returned if Mongo can't be
+// searched.
+func (r *ReferenceResolver) ResolveAll() ([]UnresolvedReference, error) {
+	var unresolved []UnresolvedReference
+
+	// create a copy of the master Mongo session for any searches
+	session := r.uploader.Session.Copy()
+	defer session.Close()
+
+	for _, entry := range r.entries {
+		source := reflect.TypeOf(entry.Resource).Elem().Name() + "/" + GetID(entry.Resource)
+
+		for _, ref := range findRefsInValue(reflect.ValueOf(entry.Resource)) {
+			if ref.Reference == "" || strings.HasPrefix(ref.Reference, "#") {
+				// identifier-only references and references to contained resources
+				continue
+			}
+
+			newRef, reason, err := r.resolve(session, ref.Reference)
+			switch {
+			case err != nil:
+				return nil, err
+			case reason != "":
+				unresolved = append(unresolved, UnresolvedReference{source, ref.Reference, reason})
+			case newRef != nil:
+				display := ref.Display
+				*ref = *newRef
+				ref.Display = display
+			}
+		}
+	}
+	return unresolved, nil
+}
+
+// resolve returns the new reference for reference, or the reason it couldn't be resolved.
+// A nil reference and no reason means the reference should be left as it is.
+func (r *ReferenceResolver) resolve(session *mgo.Session, reference string) (*models.Reference, string, error) {
+	if ref, ok := r.refs[reference]; ok {
+		return ref, "", nil
+	}
+
+	if m := conditionalRef.FindStringSubmatch(reference); m != nil {
+		return r.resolveConditional(session, m[1], m[2])
+	}
+
+	m := relativeRef.FindStringSubmatch(reference)
+	if m == nil {
+		return nil, "not a fullUrl, relative or conditional reference", nil
+	}
+	if ref, ok := r.refs[m[1]+"/"+m[2]]; ok {
+		return ref, "", nil
+	}
+	if strings.Contains(reference, "://") {
+		// an absolute reference to a resource on another server
+		return nil, "", nil
+	}
+
+	// a relative reference to a resource loaded by an earlier bundle (e.g. one with a
+	// preserved ID)
+	var count int
+	c := session.DB(r.uploader.DBName).C(models.PluralizeLowerResourceName(m[1]))
+	err := r.uploader.Retry.DoMongo(session, "Searching "+c.Name, func(attempt int) error {
+		var err error
+		count, err = c.FindId(m[2]).Count()
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if count == 0 {
+		return nil, "no such resource in the bundle or in Mongo", nil
+	}
+	return newReference(m[1], m[2]), "", nil
+}
+
+// resolveConditional resolves a conditional reference to a resource of resourceType
+// matching the search query. Only identifier searches are supported.
+func (r *ReferenceResolver) resolveConditional(session *mgo.Session, resourceType, query string) (*models.Reference, string, error) {
+	params, err := url.ParseQuery(query)
+	if err != nil || len(params) != 1 || len(params["identifier"]) != 1 {
+		return nil, "only conditional references on a single identifier are supported", nil
+	}
+
+	system, value := "", params.Get("identifier")
+	if i := strings.Index(value, "|"); i >= 0 {
+		system, value = value[:i], value[i+1:]
+	}
+
+	// first look for a match in the bundle
+	var matches []string
+	for _, entry := range r.entries {
+		if reflect.TypeOf(entry.Resource).Elem().Name() == resourceType && hasIdentifier(entry.Resource, system, value) {
+			matches = append(matches, GetID(entry.Resource))
+		}
+	}
+
+	// then in the resources that have already been loaded
+	if len(matches) == 0 {
+		selector := bson.M{"value": value}
+		if system != "" {
+			selector["system"] = system
+		}
+
+		var existing []struct {
+			ID string `bson:"_id"`
+		}
+		c := session.DB(r.uploader.DBName).C(models.PluralizeLowerResourceName(resourceType))
+		err = r.uploader.Retry.DoMongo(session, "Searching "+c.Name, func(attempt int) error {
+			q := c.Find(bson.M{"identifier": bson.M{"$elemMatch": selector}})
+			return q.Select(bson.M{"_id": 1}).Limit(2).All(&existing)
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		for _, e := range existing {
+			matches = append(matches, e.ID)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, "no resource matches the identifier", nil
+	case 1:
+		return newReference(resourceType, matches[0]), "", nil
+	}
+	return nil, "more than one resource matches the identifier", nil
+}
+
+// hasIdentifier returns true if resource has an identifier with the given system (if not
+// empty) and value.
+func hasIdentifier(resource interface{}, system, value string) bool {
+	for _, id := range identifiersOf(resource) {
+		if id.Value == value && (system == "" || id.System == system) {
+			return true
+		}
+	}
+	return false
+}
+
+// identifiersOf returns a resource's identifiers, whether it has a list of them or just one.
+func identifiersOf(resource interface{}) []models.Identifier {
+	switch v := reflect.ValueOf(resource).Elem().FieldByName("Identifier"); {
+	case !v.IsValid():
+		return nil
+	case v.Type() == reflect.TypeOf([]models.Identifier{}):
+		return v.Interface().([]models.Identifier)
+	case v.Type() == reflect.TypeOf(&models.Identifier{}) && !v.IsNil():
+		return []models.Identifier{*v.Interface().(*models.Identifier)}
+	}
+	return nil
+}
+
+// newReference returns a reference to the resource of the given type and ID on the server.
+func newReference(resourceType, id string) *models.Reference {
+	return &models.Reference{
+		Reference:    resourceType + "/" + id,
+		Type:         resourceType,
+		ReferencedID: id,
+		External:     new(bool),
+	}
+}
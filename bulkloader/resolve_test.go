@@ -0,0 +1,62 @@
+package bulkloader
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+func TestResolve(t *testing.T) {
+	r := (&Uploader{}).NewReferenceResolver()
+	for _, p := range []struct {
+		fullURL, sourceID, newID, identifier string
+	}{
+		{"urn:uuid:a", "a", "new1", "1"},
+		{"urn:uuid:b", "b", "new2", "dup"},
+		{"urn:uuid:c", "c", "new3", "dup"},
+	} {
+		patient := &models.Patient{Identifier: []models.Identifier{{System: "urn:mrn", Value: p.identifier}}}
+		SetID(patient, p.newID)
+		r.Add(&models.BundleEntryComponent{FullUrl: p.fullURL, Resource: patient}, p.sourceID)
+	}
+
+	// none of these search Mongo, so no session is needed
+	tests := []struct {
+		reference  string
+		want       string // the new reference, or "" to leave it as it is
+		wantReason bool
+	}{
+		{reference: "urn:uuid:a", want: "Patient/new1"},
+		{reference: "Patient/a", want: "Patient/new1"},
+		{reference: "Patient/a/_history/2", want: "Patient/new1"},
+		{reference: "http://example.org/fhir/Patient/a", want: "Patient/new1"},
+		{reference: "http://example.org/fhir/Patient/a/_history/2", want: "Patient/new1"},
+		{reference: "http://example.org/fhir/Patient/z"},
+		{reference: "Patient?identifier=urn:mrn|1", want: "Patient/new1"},
+		{reference: "Patient?identifier=1", want: "Patient/new1"},
+		{reference: "Patient?identifier=urn:mrn|dup", wantReason: true},
+		{reference: "Patient?identifier=1&identifier=2", wantReason: true},
+		{reference: "Patient?name=Smith", wantReason: true},
+		{reference: "Patient?identifier=%zz", wantReason: true},
+		{reference: "patient/a", wantReason: true},
+		{reference: "Patient/a b", wantReason: true},
+		{reference: "Patient/" + strings.Repeat("a", 65), wantReason: true},
+		{reference: "Patient", wantReason: true},
+	}
+
+	for _, tt := range tests {
+		ref, reason, err := r.resolve(nil, tt.reference)
+		if err != nil {
+			t.Errorf("resolve(%q): got error %s", tt.reference, err)
+			continue
+		}
+		got := ""
+		if ref != nil {
+			got = ref.Reference
+		}
+		if got != tt.want || (reason != "") != tt.wantReason {
+			t.Errorf("resolve(%q) = %q, reason %q, want %q, reason %t", tt.reference, got, reason, tt.want, tt.wantReason)
+		}
+	}
+}
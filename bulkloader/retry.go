@@ -0,0 +1,144 @@
+package bulkloader
+
+import (
+	"database/sql/driver"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"gopkg.in/mgo.v2"
+)
+
+// RetryPolicy controls how operations on Mongo and Postgres that fail with a transient
+// error (e.g. a dropped connection to a remote server) are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first. 1 disables retries.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry. It doubles with each retry, up
+	// to MaxBackoff, and a random jitter of up to half the wait is subtracted from it.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Retryable returns true if an error is transient. If nil, IsRetryable is used.
+	Retryable func(err error) bool
+}
+
+// DefaultRetryPolicy is the RetryPolicy used if none is configured.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     30 * time.Second,
+}
+
+// Do calls fn until it succeeds, fails with an error that isn't retryable, or has been
+// attempted MaxAttempts times, and returns the last error. fn is passed the attempt number,
+// starting at 1. name describes the operation in log messages.
+func (p RetryPolicy) Do(name string, fn func(attempt int) error) error {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+
+	backoff := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn(attempt)
+		if err == nil || attempt >= p.MaxAttempts || !retryable(err) {
+			return err
+		}
+
+		wait := backoff
+		if wait > 0 {
+			wait -= time.Duration(rand.Int63n(int64(wait)/2 + 1))
+		}
+		log.Printf("[RETRY] %s failed (attempt %d of %d), retrying in %s: %s\n", name, attempt, p.MaxAttempts, wait, err)
+		time.Sleep(wait)
+
+		if backoff *= 2; backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// DoMongo is like Do, but refreshes session before each retry, so that a retry doesn't
+// reuse a socket to a server that the session lost its connection to.
+func (p RetryPolicy) DoMongo(session *mgo.Session, name string, fn func(attempt int) error) error {
+	return p.Do(name, func(attempt int) error {
+		if attempt > 1 {
+			session.Refresh()
+		}
+		return fn(attempt)
+	})
+}
+
+// retryableMongoMessages are fragments of the messages of Mongo errors that are caused by
+// losing the connection to the server, or by a replica set election.
+var retryableMongoMessages = []string{
+	"no reachable servers",
+	"closed explicitly",
+	"connection reset",
+	"broken pipe",
+	"i/o timeout",
+	"not master",
+	"node is recovering",
+	"interrupted at shutdown",
+}
+
+// retryableMongoCodes are the codes of Mongo errors that are transient.
+var retryableMongoCodes = map[int]bool{
+	6:     true, // HostUnreachable
+	7:     true, // HostNotFound
+	89:    true, // NetworkTimeout
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	10107: true, // NotMaster
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotMasterNoSlaveOk
+}
+
+// IsRetryable returns true if err is a transient network, Mongo or Postgres error that
+// is likely to succeed if the operation is retried.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == driver.ErrBadConn {
+		return true
+	}
+
+	switch e := err.(type) {
+	case net.Error:
+		return true
+	case *pq.Error:
+		// connection exceptions, insufficient resources, operator intervention (e.g. the
+		// server shutting down), serialization failures and deadlocks
+		class := string(e.Code.Class())
+		return class == "08" || class == "53" || class == "57" || e.Code == "40001" || e.Code == "40P01"
+	case *mgo.QueryError:
+		if retryableMongoCodes[e.Code] {
+			return true
+		}
+	case *mgo.LastError:
+		if retryableMongoCodes[e.Code] {
+			return true
+		}
+	case *mgo.BulkError:
+		for _, ecase := range e.Cases() {
+			if IsRetryable(ecase.Err) {
+				return true
+			}
+		}
+		return false
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, fragment := range retryableMongoMessages {
+		if strings.Contains(msg, fragment) {
+			return true
+		}
+	}
+	return false
+}
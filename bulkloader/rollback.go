@@ -0,0 +1,139 @@
+package bulkloader
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// RunTagSystem is the system of the meta.tag coding that records the load run that wrote
+// a resource. The code is the run ID.
+const RunTagSystem = "https://github.com/synthetichealth/bulkfhirloader/run"
+
+// TagRun tags the resources with the ID of the load run writing them, replacing the tag of
+// any earlier run.
+func TagRun(resources []interface{}, runID string) {
+	if runID == "" {
+		return
+	}
+	for _, resource := range resources {
+		meta := getMeta(resource)
+		if meta == nil {
+			continue
+		}
+
+		tags := []models.Coding{{System: RunTagSystem, Code: runID}}
+		for _, tag := range meta.Tag {
+			if tag.System != RunTagSystem {
+				tags = append(tags, tag)
+			}
+		}
+		meta.Tag = tags
+	}
+}
+
+// runID returns the ID of the Uploader's load run, from its Manifest.
+func (u *Uploader) runID() string {
+	if u.Manifest == nil {
+		return ""
+	}
+	return u.Manifest.RunID()
+}
+
+// Rollback deletes the resources and rawstat documents written by a load run from every
+// collection the run wrote to, as recorded in its manifest, and then the manifest itself.
+// It returns the number of documents deleted from each collection. Documents written by the
+// run that a later run has since replaced (e.g. with deterministic IDs) belong to the later
+// run, and aren't deleted. Nor are shared resources that other runs also use (i.e. that are
+// tagged with other runs too, as the canonical copies of deduplicated resources are): the
+// run's tag is removed from them instead. Other references to the run's resources from
+// other runs' resources aren't looked for, and are left dangling.
+func Rollback(mongoSession *mgo.Session, dbName, runID string, retry RetryPolicy) (map[string]int, error) {
+	session := mongoSession.Copy()
+	defer session.Close()
+
+	var manifest struct {
+		Collections []string `bson:"collections"`
+	}
+	err := session.DB(dbName).C(manifestCollection).FindId(runID).One(&manifest)
+	if err == mgo.ErrNotFound {
+		return nil, fmt.Errorf("no load run with ID '%s'", runID)
+	} else if err != nil {
+		return nil, err
+	}
+
+	thisRun := bson.M{"system": RunTagSystem, "code": runID}
+	otherRun := bson.M{"system": RunTagSystem, "code": bson.M{"$ne": runID}}
+
+	deleted := make(map[string]int)
+	for _, name := range manifest.Collections {
+		c := session.DB(dbName).C(name)
+
+		selector := bson.M{"meta.tag": bson.M{"$elemMatch": thisRun}}
+		if name == "rawstat" {
+			selector = bson.M{"runid": runID}
+		} else {
+			// the resources other runs use are kept, without this run's tag
+			shared := bson.M{"$and": []bson.M{
+				{"meta.tag": bson.M{"$elemMatch": thisRun}},
+				{"meta.tag": bson.M{"$elemMatch": otherRun}},
+			}}
+			var info *mgo.ChangeInfo
+			err = retry.DoMongo(session, "Untagging "+name, func(attempt int) error {
+				var err error
+				info, err = c.UpdateAll(shared, bson.M{"$pull": bson.M{"meta.tag": thisRun}})
+				return err
+			})
+			if err != nil {
+				return deleted, fmt.Errorf("failed to untag the shared resources in %s: %s", name, err)
+			}
+			if info.Updated > 0 {
+				log.Printf("Keeping %d documents in %s that other runs use\n", info.Updated, name)
+			}
+		}
+
+		log.Printf("Deleting the documents written by run %s from %s\n", runID, name)
+		var info *mgo.ChangeInfo
+		err = retry.DoMongo(session, "Deleting from "+name, func(attempt int) error {
+			var err error
+			info, err = c.RemoveAll(selector)
+			return err
+		})
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete from %s: %s", name, err)
+		}
+		deleted[name] = info.Removed
+	}
+
+	if err = session.DB(dbName).C(manifestCollection).RemoveId(runID); err != nil {
+		return deleted, err
+	}
+	return deleted, nil
+}
+
+// RollbackSummary returns a one line summary of the documents deleted by Rollback.
+func RollbackSummary(deleted map[string]int) string {
+	var parts []string
+	for _, name := range sortedKeys(deleted) {
+		parts = append(parts, fmt.Sprintf("%d from %s", deleted[name], name))
+	}
+	if len(parts) == 0 {
+		return "Deleted nothing"
+	}
+	return "Deleted " + strings.Join(parts, ", ")
+}
+
+// sortedKeys returns the keys of a map of counts in order.
+func sortedKeys(counts map[string]int) []string {
+	var keys []string
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,115 @@
+package bulkloader
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Schema names the Postgres schema and the tables in it that the statistics are read from
+// and written to, so that deployments for several states can live side by side in one
+// database (e.g. synth_ma and synth_ri).
+type Schema struct {
+	Name           string
+	CousubDim      string
+	DiseaseDim     string
+	ConditionDim   string
+	AgeDim         string
+	PopFacts       string
+	DiseaseFacts   string
+	ConditionFacts string
+	// the active facts count the patients who had a disease or condition as of the as-of
+	// date, rather than those ever diagnosed with it
+	ActiveDiseaseFacts   string
+	ActiveConditionFacts string
+	MortalityFacts       string
+	LoadRuns             string
+	LoadRunCounts        string
+}
+
+// DefaultSchema is the SyntheticMass schema.
+var DefaultSchema = Schema{
+	Name:                 "synth_ma",
+	CousubDim:            "synth_cousub_dim",
+	DiseaseDim:           "synth_disease_dim",
+	ConditionDim:         "synth_condition_dim",
+	AgeDim:               "synth_age_dim",
+	PopFacts:             "synth_pop_facts",
+	DiseaseFacts:         "synth_disease_facts",
+	ConditionFacts:       "synth_condition_facts",
+	ActiveDiseaseFacts:   "synth_active_disease_facts",
+	ActiveConditionFacts: "synth_active_condition_facts",
+	MortalityFacts:       "synth_mortality_facts",
+	LoadRuns:             "load_runs",
+	LoadRunCounts:        "load_run_counts",
+}
+
+// validIdentifier matches a Postgres identifier that doesn't need quoting (though it's
+// quoted anyway).
+var validIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,62}$`)
+
+// tables returns pointers to the table names in the schema, by the names used for them in
+// ParseSchema.
+func (s *Schema) tables() map[string]*string {
+	return map[string]*string{
+		"cousub_dim":             &s.CousubDim,
+		"disease_dim":            &s.DiseaseDim,
+		"condition_dim":          &s.ConditionDim,
+		"age_dim":                &s.AgeDim,
+		"pop_facts":              &s.PopFacts,
+		"disease_facts":          &s.DiseaseFacts,
+		"condition_facts":        &s.ConditionFacts,
+		"active_disease_facts":   &s.ActiveDiseaseFacts,
+		"active_condition_facts": &s.ActiveConditionFacts,
+		"mortality_facts":        &s.MortalityFacts,
+		"load_runs":              &s.LoadRuns,
+		"load_run_counts":        &s.LoadRunCounts,
+	}
+}
+
+// ParseSchema returns the DefaultSchema with the given schema name, and the tables in a
+// comma-separated list of "table=name" pairs renamed, e.g. "pop_facts=synth_ri_pop_facts".
+// The tables are cousub_dim, disease_dim, condition_dim, age_dim, pop_facts, disease_facts,
+// condition_facts, active_disease_facts, active_condition_facts, mortality_facts, load_runs
+// and load_run_counts.
+func ParseSchema(name, tables string) (Schema, error) {
+	s := DefaultSchema
+	s.Name = name
+
+	if tables != "" {
+		names := s.tables()
+		for _, pair := range strings.Split(tables, ",") {
+			parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(parts) != 2 {
+				return Schema{}, fmt.Errorf("invalid table name '%s', expected table=name", pair)
+			}
+			table, ok := names[parts[0]]
+			if !ok {
+				return Schema{}, fmt.Errorf("unknown table '%s'", parts[0])
+			}
+			*table = parts[1]
+		}
+	}
+	return s, s.Validate()
+}
+
+// Validate returns an error if the schema name or any of the table names isn't a valid
+// Postgres identifier.
+func (s Schema) Validate() error {
+	if !validIdentifier.MatchString(s.Name) {
+		return fmt.Errorf("invalid schema name '%s'", s.Name)
+	}
+	for table, name := range s.tables() {
+		if !validIdentifier.MatchString(*name) {
+			return fmt.Errorf("invalid name '%s' for table %s", *name, table)
+		}
+	}
+	return nil
+}
+
+// Table returns the quoted, schema qualified name of a table, for use in SQL.
+func (s Schema) Table(name string) string {
+	return pq.QuoteIdentifier(s.Name) + "." + pq.QuoteIdentifier(name)
+}
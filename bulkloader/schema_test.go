@@ -0,0 +1,70 @@
+package bulkloader
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSchema(t *testing.T) {
+	tests := []struct {
+		name, tables string
+		check        func(s Schema) bool // nil if an error is wanted
+	}{
+		{"synth_ma", "", func(s Schema) bool { return s == DefaultSchema }},
+		{"synth_ri", "", func(s Schema) bool { return s.Name == "synth_ri" && s.PopFacts == DefaultSchema.PopFacts }},
+		{"synth_ri", "pop_facts=synth_ri_pop_facts", func(s Schema) bool {
+			return s.PopFacts == "synth_ri_pop_facts" && s.DiseaseFacts == DefaultSchema.DiseaseFacts
+		}},
+		{"synth_ri", " pop_facts=ri_pop , load_runs=ri_runs", func(s Schema) bool {
+			return s.PopFacts == "ri_pop" && s.LoadRuns == "ri_runs"
+		}},
+		{"_private", "age_dim=Ages_2", func(s Schema) bool { return s.AgeDim == "Ages_2" }},
+		{"synth_ri", "pop_facts", nil},
+		{"synth_ri", "pop=synth_ri_pop_facts", nil},
+		{"synth_ri", "pop_facts=", nil},
+		{"synth_ri", "pop_facts=ri pop", nil},
+		{"synth_ri", `pop_facts=ri"pop`, nil},
+		{"synth_ri", "pop_facts=ri;drop table x", nil},
+		{"synth_ri", "pop_facts=1pop", nil},
+		{"synth_ri", "pop_facts=" + strings.Repeat("a", 64), nil},
+		{"synth_ri", "pop_facts=ri.pop", nil},
+		{"", "", nil},
+		{"synth-ri", "", nil},
+		{"9synth", "", nil},
+		{"synth.ri", "", nil},
+		{strings.Repeat("a", 64), "", nil},
+	}
+
+	for _, tt := range tests {
+		s, err := ParseSchema(tt.name, tt.tables)
+		switch {
+		case tt.check == nil && err == nil:
+			t.Errorf("ParseSchema(%q, %q): got %+v, want an error", tt.name, tt.tables, s)
+		case tt.check != nil && err != nil:
+			t.Errorf("ParseSchema(%q, %q): got error %s", tt.name, tt.tables, err)
+		case tt.check != nil && !tt.check(s):
+			t.Errorf("ParseSchema(%q, %q): got %+v", tt.name, tt.tables, s)
+		}
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	if err := DefaultSchema.Validate(); err != nil {
+		t.Errorf("DefaultSchema: got error %s", err)
+	}
+
+	// every table name is checked
+	for table := range DefaultSchema.tables() {
+		s := DefaultSchema
+		*s.tables()[table] = `x"; drop schema synth_ma cascade; --`
+		if err := s.Validate(); err == nil || !strings.Contains(err.Error(), table) {
+			t.Errorf("invalid name for %s: got error %v, want one naming the table", table, err)
+		}
+	}
+
+	s := DefaultSchema
+	s.Name = strings.Repeat("a", 63)
+	if err := s.Validate(); err != nil {
+		t.Errorf("63 character schema name: got error %s", err)
+	}
+}
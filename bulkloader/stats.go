@@ -0,0 +1,209 @@
+package bulkloader
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// rebuildCollection is the collection the rawstat documents are rebuilt into, before it
+// replaces the rawstat collection.
+const rebuildCollection = "rawstat_rebuild"
+
+// rebuildBatchSize is the number of rawstat documents written to Mongo at a time.
+const rebuildBatchSize = 1000
+
+// RebuildReport counts the resources read by RebuildStats.
+type RebuildReport struct {
+	Patients          int
+	Conditions        int
+	CausesOfDeath     int
+	SkippedPatients   int
+	SkippedConditions int
+}
+
+// Summary returns a one line summary of the rebuild.
+func (r *RebuildReport) Summary() string {
+	return fmt.Sprintf("Rebuilt rawstat from %d patients, %d conditions and %d causes of death (%d patients and %d conditions skipped)",
+		r.Patients, r.Conditions, r.CausesOfDeath, r.SkippedPatients, r.SkippedConditions)
+}
+
+// RebuildStats rebuilds the rawstat collection from the patients, conditions and causes of
+// death already in Mongo, using the current subdivisions, diseases and age bands and the
+// ages as of asOf, so that the statistics can be recalculated (e.g. after a disease is
+// added to the condition dimension table) without loading the bundles again. The documents
+// are built into a separate collection, which then replaces rawstat. Patients and
+// conditions that the statistics can't be collected for are logged and skipped, as they
+// would have failed to load.
+func RebuildStats(mongoSession *mgo.Session, dbName string, cousubs CousubMap, diseases DiseaseMap, ages AgeBands, asOf time.Time, retry RetryPolicy) (*RebuildReport, error) {
+	session := mongoSession.Copy()
+	defer session.Close()
+
+	report := &RebuildReport{}
+	db := session.DB(dbName)
+
+	// start from scratch if an earlier rebuild was interrupted
+	names, err := db.CollectionNames()
+	if err != nil {
+		return report, err
+	}
+	for _, name := range names {
+		if name == rebuildCollection {
+			if err = db.C(rebuildCollection).DropCollection(); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	var pairs []interface{}
+	flush := func(upsert bool) error {
+		if len(pairs) == 0 {
+			return nil
+		}
+		// the upserts and updates are idempotent, so they can simply be run again
+		err := retry.DoMongo(session, "Rebuilding rawstat", func(attempt int) error {
+			x := session.DB(dbName).C(rebuildCollection).Bulk()
+			x.Unordered()
+			if upsert {
+				x.Upsert(pairs...)
+			} else {
+				x.Update(pairs...)
+			}
+			_, err := x.Run()
+			return err
+		})
+		pairs = pairs[:0]
+		return err
+	}
+
+	log.Println("Rebuilding rawstat from patients")
+	iter := db.C("patients").Find(nil).Batch(rebuildBatchSize).Iter()
+	for {
+		var p models.Patient
+		if !iter.Next(&p) {
+			break
+		}
+		var basestat RawStats
+		warning, err := setPatientStats(&basestat, &p, cousubs, ages, asOf)
+		if err == nil {
+			err = warning
+		}
+		if err != nil {
+			log.Println("[WARNING] Skipping patient:", err)
+			report.SkippedPatients++
+			continue
+		}
+		basestat.RunID = runTag(p.Meta)
+		report.Patients++
+
+		pairs = append(pairs, bson.M{"_id": basestat.ID}, basestat)
+		if len(pairs) >= 2*rebuildBatchSize {
+			if err = flush(true); err != nil {
+				iter.Close()
+				return report, err
+			}
+		}
+	}
+	if err = iter.Close(); err != nil {
+		return report, err
+	}
+	if err = flush(true); err != nil {
+		return report, err
+	}
+	if report.Patients == 0 {
+		// replacing rawstat would leave no statistics at all
+		return report, errors.New("there are no patients to rebuild rawstat from")
+	}
+
+	log.Println("Rebuilding rawstat from conditions")
+	iter = db.C("conditions").Find(nil).Batch(rebuildBatchSize).Iter()
+	for {
+		var c models.Condition
+		if !iter.Next(&c) {
+			break
+		}
+		if c.Subject == nil || c.Subject.Type != "Patient" || c.Subject.ReferencedID == "" {
+			report.SkippedConditions++
+			continue
+		}
+		condcodes, err := getConditionCodes(&c, diseases)
+		if err != nil {
+			log.Println("[WARNING] Skipping condition:", err)
+			report.SkippedConditions++
+			continue
+		}
+		report.Conditions++
+
+		pairs = append(pairs, bson.M{"_id": c.Subject.ReferencedID}, conditionUpdate(condcodes, asOf))
+		if len(pairs) >= 2*rebuildBatchSize {
+			if err = flush(false); err != nil {
+				iter.Close()
+				return report, err
+			}
+		}
+	}
+	if err = iter.Close(); err != nil {
+		return report, err
+	}
+	if err = flush(false); err != nil {
+		return report, err
+	}
+
+	log.Println("Rebuilding rawstat from causes of death")
+	iter = db.C("observations").Find(bson.M{"code.coding": bson.M{"$elemMatch": bson.M{"system": "http://loinc.org", "code": causeOfDeathCode}}}).Batch(rebuildBatchSize).Iter()
+	for {
+		var o models.Observation
+		if !iter.Next(&o) {
+			break
+		}
+		if o.Subject == nil || o.Subject.Type != "Patient" || o.Subject.ReferencedID == "" {
+			continue
+		}
+		cause, ok := getCauseOfDeath(&o, diseases)
+		if !ok {
+			continue
+		}
+		report.CausesOfDeath++
+
+		pairs = append(pairs, bson.M{"_id": o.Subject.ReferencedID}, bson.M{"$set": bson.M{"causeofdeath": cause}})
+		if len(pairs) >= 2*rebuildBatchSize {
+			if err = flush(false); err != nil {
+				iter.Close()
+				return report, err
+			}
+		}
+	}
+	if err = iter.Close(); err != nil {
+		return report, err
+	}
+	if err = flush(false); err != nil {
+		return report, err
+	}
+
+	log.Println("Replacing rawstat")
+	err = session.DB("admin").Run(bson.D{
+		{Name: "renameCollection", Value: dbName + "." + rebuildCollection},
+		{Name: "to", Value: dbName + ".rawstat"},
+		{Name: "dropTarget", Value: true},
+	}, nil)
+	return report, err
+}
+
+// runTag returns the ID of the load run that wrote a resource, from its meta.tag, or "" if
+// it has none.
+func runTag(meta *models.Meta) string {
+	if meta == nil {
+		return ""
+	}
+	for _, tag := range meta.Tag {
+		if tag.System == RunTagSystem {
+			return tag.Code
+		}
+	}
+	return ""
+}
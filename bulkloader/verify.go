@@ -0,0 +1,267 @@
+package bulkloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/search"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// verifyBatchSize is the number of references checked against Mongo at a time.
+const verifyBatchSize = 1000
+
+// maxDanglingExamples is the number of dangling references listed for each pair of source
+// and target resource types in an IntegrityReport.
+const maxDanglingExamples = 20
+
+// collectionResourceTypes maps the FHIR collections in collectionNames to the resource
+// type of their documents.
+var collectionResourceTypes = map[string]string{
+	"allergyintolerances": "AllergyIntolerance",
+	"careplans":           "CarePlan",
+	"conditions":          "Condition",
+	"diagnosticreports":   "DiagnosticReport",
+	"encounters":          "Encounter",
+	"immunizations":       "Immunization",
+	"medicationrequests":  "MedicationRequest",
+	"observations":        "Observation",
+	"patients":            "Patient",
+	"procedures":          "Procedure",
+}
+
+// collectionResourceType returns the resource type of the documents in a FHIR collection,
+// or false if name isn't the collection of a resource type (e.g. rawstat).
+func collectionResourceType(name string) (string, bool) {
+	if resourceType, ok := collectionResourceTypes[name]; ok {
+		return resourceType, true
+	}
+	for resourceType := range search.SearchParameterDictionary {
+		if models.PluralizeLowerResourceName(resourceType) == name && models.NewStructForResourceName(resourceType) != nil {
+			return resourceType, true
+		}
+	}
+	return "", false
+}
+
+// DanglingReferences are the references from resources of one type to resources of
+// another type that don't exist.
+type DanglingReferences struct {
+	SourceType string   `json:"sourceType"`
+	TargetType string   `json:"targetType"`
+	Count      int      `json:"count"`
+	Examples   []string `json:"examples"` // "SourceType/id -> reference", up to maxDanglingExamples
+}
+
+// IntegrityReport is the result of VerifyReferences.
+type IntegrityReport struct {
+	Resources  int                   `json:"resources"`
+	References int                   `json:"references"`
+	Dangling   int                   `json:"dangling"`
+	Groups     []*DanglingReferences `json:"groups"`
+}
+
+// WriteJSON writes the report to a JSON file at path.
+func (r *IntegrityReport) WriteJSON(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Summary returns a summary of the report, with a line for each group of dangling
+// references.
+func (r *IntegrityReport) Summary() string {
+	summary := fmt.Sprintf("%d references in %d resources checked, %d dangling", r.References, r.Resources, r.Dangling)
+	for _, g := range r.Groups {
+		summary += fmt.Sprintf("\n  %s -> %s: %d", g.SourceType, g.TargetType, g.Count)
+	}
+	return summary
+}
+
+// pendingRef is a reference waiting to be checked against Mongo.
+type pendingRef struct {
+	source     string // "SourceType/id"
+	sourceType string
+	targetType string
+	targetID   string
+	reference  string
+}
+
+// referenceVerifier checks references against Mongo in batches, and records the dangling
+// ones in an IntegrityReport.
+type referenceVerifier struct {
+	session *mgo.Session
+	dbName  string
+	retry   RetryPolicy
+	report  *IntegrityReport
+	groups  map[[2]string]*DanglingReferences
+	pending []pendingRef
+}
+
+// VerifyReferences checks that every reference in the FHIR collections in Mongo points at
+// an existing resource of the referenced type. The default collections are walked, along
+// with the collections recorded in the manifests of previous loads. References to contained resources, and
+// absolute references to other servers, aren't checked.
+func VerifyReferences(mongoSession *mgo.Session, dbName string, retry RetryPolicy) (*IntegrityReport, error) {
+	session := mongoSession.Copy()
+	defer session.Close()
+
+	v := &referenceVerifier{
+		session: session,
+		dbName:  dbName,
+		retry:   retry,
+		report:  &IntegrityReport{Groups: []*DanglingReferences{}},
+		groups:  make(map[[2]string]*DanglingReferences),
+	}
+
+	// walk the collections written by previous loads, and the default collections in case
+	// they were written by loads from before there was a manifest
+	var recorded []string
+	err := retry.DoMongo(session, "Reading "+manifestCollection, func(attempt int) error {
+		var err error
+		recorded, err = manifestCollections(session, dbName)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the collections written by previous loads: %s", err)
+	}
+	seen := make(map[string]bool)
+	for _, name := range append(append([]string{}, collectionNames...), recorded...) {
+		resourceType, ok := collectionResourceType(name)
+		if !ok || seen[name] {
+			continue
+		}
+		seen[name] = true
+		log.Println("Verifying references in", name)
+
+		iter := session.DB(dbName).C(name).Find(nil).Batch(verifyBatchSize).Iter()
+		for {
+			resource := models.NewStructForResourceName(resourceType)
+			if !iter.Next(resource) {
+				break
+			}
+			v.report.Resources++
+			source := resourceType + "/" + GetID(resource)
+
+			for _, ref := range findRefsInValue(reflect.ValueOf(resource)) {
+				targetType, targetID, ok := referenceTarget(ref)
+				if !ok {
+					continue
+				}
+				v.report.References++
+				v.pending = append(v.pending, pendingRef{source, resourceType, targetType, targetID, ref.Reference})
+				if len(v.pending) >= verifyBatchSize {
+					if err := v.flush(); err != nil {
+						iter.Close()
+						return nil, err
+					}
+				}
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := v.flush(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(v.report.Groups, func(i, j int) bool {
+		a, b := v.report.Groups[i], v.report.Groups[j]
+		if a.SourceType != b.SourceType {
+			return a.SourceType < b.SourceType
+		}
+		return a.TargetType < b.TargetType
+	})
+	return v.report, nil
+}
+
+// flush checks the pending references against Mongo, one query per target type.
+func (v *referenceVerifier) flush() error {
+	byType := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, p := range v.pending {
+		if key := p.targetType + "/" + p.targetID; !seen[key] {
+			seen[key] = true
+			byType[p.targetType] = append(byType[p.targetType], p.targetID)
+		}
+	}
+
+	existing := make(map[string]bool)
+	for targetType, ids := range byType {
+		var found []struct {
+			ID string `bson:"_id"`
+		}
+		c := v.session.DB(v.dbName).C(models.PluralizeLowerResourceName(targetType))
+		err := v.retry.DoMongo(v.session, "Verifying references to "+c.Name, func(attempt int) error {
+			return c.Find(bson.M{"_id": bson.M{"$in": ids}}).Select(bson.M{"_id": 1}).All(&found)
+		})
+		if err != nil {
+			return err
+		}
+		for _, f := range found {
+			existing[targetType+"/"+f.ID] = true
+		}
+	}
+
+	for _, p := range v.pending {
+		if existing[p.targetType+"/"+p.targetID] {
+			continue
+		}
+		v.report.Dangling++
+
+		key := [2]string{p.sourceType, p.targetType}
+		g, ok := v.groups[key]
+		if !ok {
+			g = &DanglingReferences{SourceType: p.sourceType, TargetType: p.targetType, Examples: []string{}}
+			v.groups[key] = g
+			v.report.Groups = append(v.report.Groups, g)
+		}
+		g.Count++
+		if len(g.Examples) < maxDanglingExamples {
+			g.Examples = append(g.Examples, p.source+" -> "+p.reference)
+		}
+	}
+	v.pending = v.pending[:0]
+	return nil
+}
+
+// referenceTarget returns the resource type and ID a reference points at, preferring the
+// Type and ReferencedID the loader sets over parsing the reference string. ok is false if
+// the reference shouldn't be checked.
+func referenceTarget(ref *models.Reference) (targetType, targetID string, ok bool) {
+	if ref.Reference == "" || strings.HasPrefix(ref.Reference, "#") {
+		return "", "", false
+	}
+	if ref.External != nil && *ref.External {
+		return "", "", false
+	}
+
+	targetType, targetID = ref.Type, ref.ReferencedID
+	if targetType == "" || targetID == "" {
+		if strings.Contains(ref.Reference, "://") {
+			return "", "", false
+		}
+		m := relativeRef.FindStringSubmatch(ref.Reference)
+		if m == nil {
+			// not resolvable at all, so report it as dangling under an unknown type
+			return "Unknown", ref.Reference, true
+		}
+		if targetType == "" {
+			targetType = m[1]
+		}
+		if targetID == "" {
+			targetID = m[2]
+		}
+	}
+	return targetType, targetID, true
+}
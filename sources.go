@@ -0,0 +1,157 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/synthetichealth/bulkfhirloader/bulkloader"
+)
+
+// bundleFile is a FHIR bundle (or NDJSON file) waiting to be processed by a worker.
+// Members of an archive are read into memory by the walker, since an archive can only
+// be read sequentially; data is nil for files on disk.
+type bundleFile struct {
+	path string // for archive members, the path of the archive joined with the member path
+	data []byte
+}
+
+// open returns a reader for the contents of the bundleFile.
+func (bf bundleFile) open() (io.ReadCloser, error) {
+	if bf.data != nil {
+		return ioutil.NopCloser(bytes.NewReader(bf.data)), nil
+	}
+	return os.Open(bf.path)
+}
+
+// read returns the contents of the bundleFile.
+func (bf bundleFile) read() ([]byte, error) {
+	if bf.data != nil {
+		return bf.data, nil
+	}
+	return ioutil.ReadFile(bf.path)
+}
+
+// isArchive returns true if the path is an archive the walker can read bundles from.
+func isArchive(path string) bool {
+	return strings.HasSuffix(path, ".tar.gz") || strings.HasSuffix(path, ".tgz") || strings.HasSuffix(path, ".zip")
+}
+
+// walkArchive calls fn for each regular file in a .tar.gz, .tgz or .zip archive whose
+// name ends with suffix. The name passed to fn is the archive path joined with the
+// member path, and r is only valid until fn returns.
+func walkArchive(path, suffix string, fn func(name string, r io.Reader) error) error {
+	if strings.HasSuffix(path, ".zip") {
+		return walkZip(path, suffix, fn)
+	}
+	return walkTarGz(path, suffix, fn)
+}
+
+func walkTarGz(path, suffix string, fn func(name string, r io.Reader) error) error {
+	archiveFile, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer archiveFile.Close()
+
+	gz, err := gzip.NewReader(archiveFile)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || !strings.HasSuffix(hdr.Name, suffix) {
+			continue
+		}
+		if err = fn(filepath.Join(path, hdr.Name), tr); err != nil {
+			return err
+		}
+	}
+}
+
+func walkZip(path, suffix string, fn func(name string, r io.Reader) error) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() || !strings.HasSuffix(zf.Name, suffix) {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = fn(filepath.Join(path, zf.Name), rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanNDJSONFiles registers every resource in the NDJSON files in a specified path with a
+// new IDRegistry, so that references between files can be rewritten as they are uploaded.
+// The resources in files in the quarantine (if quarantine isn't nil) were given their IDs
+// by the load that quarantined them, and keep them.
+func scanNDJSONFiles(root string, strategy bulkloader.IDStrategy, quarantine *bulkloader.Quarantine) (*bulkloader.IDRegistry, error) {
+	registry := bulkloader.NewIDRegistry(strategy)
+
+	scan := func(name string, r io.Reader, assigned bool) error {
+		if err := bulkloader.ScanNDJSON(r, registry, assigned); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		return nil
+	}
+
+	err := filepath.Walk(root, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			return nil
+		}
+		if isArchive(path) {
+			// a corrupt archive is recorded as a failure when it's loaded
+			err := walkArchive(path, ".ndjson", func(name string, r io.Reader) error {
+				return scan(name, r, false)
+			})
+			if err != nil {
+				log.Printf("Failed to scan %s: %s\n", path, err)
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".ndjson") {
+			return nil
+		}
+
+		ndjsonFile, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer ndjsonFile.Close()
+
+		return scan(path, ndjsonFile, quarantine != nil && quarantine.Contains(path))
+	})
+	return registry, err
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/synthetichealth/bulkfhirloader/bulkloader"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ndjsonBatchSize is the number of NDJSON resources uploaded to Mongo at a time.
+const ndjsonBatchSize = 1000
+
+// loader holds the state shared by all of the workers in a load.
+type loader struct {
+	counter    uint64 // total number of FHIR bundles (or NDJSON resources) processed
+	uploader   *bulkloader.Uploader
+	ids        bulkloader.IDStrategy
+	registry   *bulkloader.IDRegistry // only used when loading NDJSON files
+	journal    *bulkloader.Journal
+	report     *bulkloader.ErrorReport
+	quarantine *bulkloader.Quarantine    // nil unless -quarantine is set
+	dedup      *bulkloader.DedupRegistry // nil unless -dedup is set
+}
+
+// worker uses a WorkerChannel to process all of the resources in a single FHIR bundle, specified by the path to that bundle's JSON file.
+func (l *loader) worker(wg *sync.WaitGroup, bundles <-chan bundleFile) {
+	defer wg.Done()
+
+	for bf := range bundles {
+		atomic.AddUint64(&l.counter, 1)
+
+		jsonData, err := bf.read()
+		if err != nil {
+			log.Println(l.report.Failure(bf.path, bulkloader.StageRead, err))
+			continue
+		}
+
+		if berr := l.loadBundle(bf.path, jsonData); berr != nil {
+			log.Println(berr)
+			l.quarantineData(berr, jsonData, ".json")
+			continue
+		}
+		l.report.Success(1)
+		l.release(bf.path)
+
+		// the bundle is in Mongo now, so a resumed load can skip it
+		if err = l.journal.Record(bf.path); err != nil {
+			log.Println("Failed to record bundle in checkpoint journal:", err)
+		}
+	}
+}
+
+// loadBundle uploads all of the resources in a single FHIR bundle. If the bundle fails to
+// load, the failure is recorded in the error report and returned.
+func (l *loader) loadBundle(path string, jsonData []byte) (berr *bulkloader.BundleError) {
+	var bundle models.Bundle
+	if err := json.Unmarshal(jsonData, &bundle); err != nil {
+		return l.report.Failure(path, bulkloader.StageDecode, err)
+	}
+
+	entries := make([]*models.BundleEntryComponent, len(bundle.Entry))
+	for i := range bundle.Entry {
+		entries[i] = &bundle.Entry[i]
+		if entries[i].Resource == nil {
+			return l.report.Failure(path, bulkloader.StageDecode, fmt.Errorf("entry %d (%s) has no resource or an unknown resource type", i, entries[i].FullUrl))
+		}
+	}
+
+	var bundleKey string
+	if l.ids == bulkloader.DeterministicIDs {
+		bundleKey = bulkloader.BundleIdentity(&bundle, jsonData)
+	}
+
+	// if the bundle fails, the shared resources it was to upload are left to later bundles
+	var claims []*bulkloader.DedupClaim
+	defer func() {
+		if berr != nil && len(claims) > 0 {
+			l.dedup.Release(claims)
+		}
+	}()
+
+	resolver := l.uploader.NewReferenceResolver()
+	duplicates := make([]bool, len(entries))
+	for i, entry := range entries {
+		// Create a new ID, remembering the source ID so relative references can be resolved
+		sourceID := bulkloader.GetID(entry.Resource)
+		id := l.entryID(bundleKey, i, entry)
+		if l.dedup != nil {
+			canonical, claim, duplicate, err := l.dedup.Canonical(entry.Resource, id)
+			if err != nil {
+				return l.report.Failure(path, bulkloader.StageReference, err)
+			}
+			if claim != nil {
+				claims = append(claims, claim)
+			}
+			id, duplicates[i] = canonical, duplicate
+		}
+		bulkloader.SetID(entry.Resource, id)
+		resolver.Add(entry, sourceID)
+	}
+
+	// Update all the references to the entries (to reflect newly assigned IDs)
+	unresolved, err := resolver.ResolveAll()
+	if err != nil {
+		return l.report.Failure(path, bulkloader.StageReference, err)
+	}
+	for _, u := range unresolved {
+		log.Println(l.report.Warning(path, bulkloader.StageReference, fmt.Errorf("unresolved reference %s", u)))
+	}
+
+	// copies of shared resources that have already been uploaded are dropped
+	var resources []interface{}
+	for i := range entries {
+		if !duplicates[i] {
+			resources = append(resources, entries[i].Resource)
+		}
+	}
+
+	warnings, err := l.uploader.UploadResources(resources)
+	if err != nil {
+		return l.report.Failure(path, bulkloader.StageMongo, err)
+	}
+	for _, w := range warnings {
+		log.Println(l.report.Warning(path, bulkloader.StageStats, w))
+	}
+	return nil
+}
+
+// entryID returns the new ID for the i'th entry in a bundle, according to the loader's
+// IDStrategy. bundleKey is the bundle's identity, and is only used for DeterministicIDs.
+func (l *loader) entryID(bundleKey string, i int, entry *models.BundleEntryComponent) string {
+	switch l.ids {
+	case bulkloader.DeterministicIDs:
+		if entry.FullUrl == "" {
+			return bulkloader.DeterministicID(bundleKey, fmt.Sprintf("entry/%d", i))
+		}
+		return bulkloader.DeterministicID(bundleKey, entry.FullUrl)
+	case bulkloader.PreservedIDs:
+		if id := bulkloader.GetID(entry.Resource); bulkloader.ValidID(id) {
+			return id
+		}
+	}
+	return bson.NewObjectId().Hex()
+}
+
+// ndjsonWorker processes all of the resources in a single FHIR Bulk Data NDJSON file,
+// specified by the path to that file.
+func (l *loader) ndjsonWorker(wg *sync.WaitGroup, files <-chan bundleFile) {
+	defer wg.Done()
+
+	for bf := range files {
+		if !l.loadNDJSONFile(bf) {
+			continue
+		}
+		l.release(bf.path)
+
+		// every resource in the file is in Mongo now, so a resumed load can skip it
+		if err := l.journal.Record(bf.path); err != nil {
+			log.Println("Failed to record NDJSON file in checkpoint journal:", err)
+		}
+	}
+}
+
+// loadNDJSONFile uploads all of the resources in a single NDJSON file, in batches of
+// ndjsonBatchSize, and returns true if every one of them loaded. A resource that fails to
+// load is recorded in the error report under the path and line number of the resource, and
+// a batch that fails to upload under the range of lines in the batch. The failed resources
+// are quarantined together, in a file with the same name as the NDJSON file. They're
+// quarantined with their new IDs and rewritten references (or just their new IDs if they
+// couldn't be decoded), and keep the IDs when they're retried, so that the references
+// between them and the resources that did load still resolve.
+func (l *loader) loadNDJSONFile(bf bundleFile) bool {
+	ndjsonFile, err := bf.open()
+	if err != nil {
+		log.Println(l.report.Failure(bf.path, bulkloader.StageRead, err))
+		return false
+	}
+	defer ndjsonFile.Close()
+
+	var failures []*bulkloader.BundleError
+	var failed [][]byte
+	fail := func(berr *bulkloader.BundleError, lines ...[]byte) {
+		log.Println(berr)
+		failures = append(failures, berr)
+		failed = append(failed, lines...)
+	}
+
+	batch := l.uploader.NewNDJSONBatch()
+	var batchLines [][]byte
+	var firstLine, lastLine int
+
+	upload := func() {
+		atomic.AddUint64(&l.counter, uint64(batch.Len()))
+		if err := batch.Upload(); err != nil {
+			path := fmt.Sprintf("%s:%d-%d", bf.path, firstLine, lastLine)
+			fail(l.report.BatchFailure(path, bulkloader.StageMongo, err, batch.Len()), batchLines...)
+			return
+		}
+		l.report.Success(batch.Len())
+	}
+
+	err = bulkloader.ReadNDJSONLines(ndjsonFile, func(lineNum int, line []byte) error {
+		linePath := fmt.Sprintf("%s:%d", bf.path, lineNum)
+
+		resource, err := bulkloader.DecodeResource(line)
+		if err != nil {
+			fail(l.report.Failure(linePath, bulkloader.StageDecode, err), bulkloader.AssignNDJSONID(line, l.registry))
+			return nil
+		}
+
+		resourceType := reflect.TypeOf(resource).Elem().Name()
+		if id := bulkloader.GetID(resource); id != "" {
+			bulkloader.SetID(resource, l.registry.Register(resourceType, id))
+		} else if l.ids == bulkloader.DeterministicIDs {
+			bulkloader.SetID(resource, bulkloader.DeterministicID(resourceType, string(line)))
+		} else {
+			bulkloader.SetID(resource, bson.NewObjectId().Hex())
+		}
+		bulkloader.UpdateNDJSONReferences(resource, l.registry)
+
+		// the resource as it is now, with its new ID and references, to quarantine if it fails
+		if l.quarantine != nil {
+			if rewritten, err := json.Marshal(resource); err == nil {
+				line = rewritten
+			}
+		}
+
+		warning, err := batch.Add(resource)
+		if warning != nil {
+			log.Println(l.report.Warning(linePath, bulkloader.StageStats, warning))
+		}
+		if err != nil {
+			fail(l.report.Failure(linePath, bulkloader.StageStats, err), line)
+			return nil
+		}
+		if batch.Len() == 1 {
+			firstLine = lineNum
+		}
+		lastLine = lineNum
+		batchLines = append(batchLines, line)
+
+		if batch.Len() == ndjsonBatchSize {
+			upload()
+			batch = l.uploader.NewNDJSONBatch()
+			batchLines = nil
+		}
+		return nil
+	})
+	readErr := err
+
+	if batch.Len() > 0 {
+		upload()
+	}
+
+	if readErr != nil {
+		log.Println(l.report.Failure(bf.path, bulkloader.StageRead, readErr))
+		if l.quarantine != nil && l.quarantine.Contains(bf.path) {
+			// the rest of the file wasn't read, so it can't be replaced by its failed lines
+			return false
+		}
+	}
+
+	if len(failures) > 0 && l.quarantine != nil {
+		if err = l.quarantine.AddNDJSON(bf.path, failures, failed); err != nil {
+			log.Printf("Failed to quarantine %s: %s\n", bf.path, err)
+		}
+	}
+	return len(failures) == 0 && readErr == nil
+}
+
+// quarantineData copies the data of a bundle that failed to load to the quarantine
+// directory, if there is one.
+func (l *loader) quarantineData(berr *bulkloader.BundleError, data []byte, ext string) {
+	if l.quarantine == nil {
+		return
+	}
+	if err := l.quarantine.Add(berr, data, ext); err != nil {
+		log.Printf("Failed to quarantine %s: %s\n", berr.Path, err)
+	}
+}
+
+// release removes a bundle that was retried from the quarantine directory and has now
+// loaded successfully.
+func (l *loader) release(path string) {
+	if l.quarantine == nil {
+		return
+	}
+	if err := l.quarantine.Release(path); err != nil {
+		log.Printf("Failed to remove %s from quarantine: %s\n", path, err)
+	}
+}